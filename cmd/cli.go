@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jamiealquiza/envy"
@@ -13,17 +14,51 @@ import (
 )
 
 type Config struct {
-	BroadcastAddress *net.UDPAddr
-	Retries          int
-	MqttBroker       string
-	MqttUsername     string
-	MqttPassword     string
-	MqttVerifySSL    bool
-	MqttBaseTopic    string
-	ClientID         string
-	HassDiscovery    bool
-	XPLHops          int
-	XPLTarget        string
+	BroadcastAddress  *net.UDPAddr
+	Retries           int
+	MqttBroker        string
+	MqttUsername      string
+	MqttPassword      string
+	MqttVerifySSL     bool
+	MqttBaseTopic     string
+	ClientID          string
+	HassDiscovery     bool
+	XPLHops           int
+	XPLTarget         string
+	XPLInstance       string
+	XPLMode           string
+	XPLInterval       int
+	XPLGroups         []string
+	XPLFilters        []string
+	XPLConfigFile     string
+	XPLWaitConfig     bool
+	XPLInterfaces     []string
+	XPLIPv6           bool
+	XPLMulticastGroup string
+	GatewayDiscovery  bool
+	GatewaySource     string
+	Gateways          []Gateway
+	Routes            []Route
+	TopicTemplate     string
+	TopicState        string
+	TopicSet          string
+	TopicGet          string
+	Aliases           []Alias
+	JsonState         bool
+	StateFile         string
+	OptimisticSchemas []string
+	OptimisticExclude []string
+	CommandTimeout    time.Duration
+	ReassertSchemas   []string
+	ReassertInterval  time.Duration
+	ReassertCount     int
+	ReassertOnStart   bool
+	GenericDecoder    bool
+	GenericExclude    []string
+	Raw               bool
+	DedupWindow       time.Duration
+	TxSpacing         time.Duration
+	TxQueueSize       int
 }
 
 var ConfigData Config
@@ -43,6 +78,40 @@ func Parse() {
 	hass := flag.Bool("hass-discovery", true, "enable home-assistant mqtt discovery")
 	xplTarget := flag.String("xpl-target", "*", "xpl target")
 	xplHops := flag.Int("xpl-hops", 1, "xpl hops")
+	xplMode := flag.String("xpl-mode", "standalone", "xpl network mode: standalone, hub or client")
+	xplInterval := flag.Int("xpl-interval", 5, "xpl heartbeat interval in minutes")
+	xplGroups := flag.String("xpl-groups", "", "comma separated list of xpl groups of the bridge, in the xpl-group.name format")
+	xplFilters := flag.String("xpl-filters", "", "comma separated list of xpl filters, in the msgtype.vendor.device.instance.class.type format")
+	xplInterfaces := flag.String("xpl-interfaces", "", "comma separated list of network interfaces used for xpl, empty for all")
+	xplIPv6 := flag.Bool("xpl-ipv6", false, "also use ipv6 multicast for xpl")
+	xplGroup := flag.String("xpl-multicast-group", "ff02::3865", "ipv6 multicast group used for xpl")
+	gwDiscovery := flag.Bool("gateway-discovery", true, "send the commands directly to the gateway learned from its heartbeats")
+	gwSource := flag.String("gateway-source", "rfxcom-lan.*", "xpl source of the gateways, * matches any value")
+	gws := flag.String("gateways", "", "comma separated list of gateways, in the name=[source@]host[:port] format")
+	routes := flag.String("routes", "", "comma separated list of routing rules, in the schema[/device_type[/device_id]]=gateway format")
+	topicTemplate := flag.String("topic-template", "{base}/{schema}/{device_type}/{device_id}/{param}/{action}", "layout of the device topics")
+	topicState := flag.String("topic-state", "state", "name of the state action in the topics, empty to remove its level")
+	topicSet := flag.String("topic-set", "set", "name of the command action in the topics")
+	topicGet := flag.String("topic-get", "get", "name of the action requesting the last state in the topics")
+	optimistic := flag.String("optimistic", "", "comma separated list of xpl schemas whose state is published as soon as a command is sent, for devices which do not report back")
+	optimisticExclude := flag.String("optimistic-exclude", "", "comma separated list of devices which report their state, in the schema[/device_type[/device_id]] format")
+	commandTimeout := flag.Duration("command-timeout", 10*time.Second, "maximum time to wait for the transmission and confirmation of a command with a request id")
+	reassert := flag.String("reassert", "", "comma separated list of xpl schemas whose last command is re-sent, for devices which may miss commands")
+	reassertInterval := flag.Duration("reassert-interval", 15*time.Minute, "delay between the re-sends of the last command, 0 to only re-send on startup")
+	reassertCount := flag.Int("reassert-count", 0, "number of re-sends after a command, the delay doubling after each one, 0 to re-send forever every reassert-interval")
+	reassertOnStart := flag.Bool("reassert-on-start", true, "re-send the last commands on startup")
+	stateFile := flag.String("state-file", "xpl2mqtt-state.json", "file storing the last state of every device parameter across restarts, empty to disable")
+	jsonState := flag.Bool("json-state", false, "publish one json document per device with all its parameters, instead of one topic per parameter")
+	aliases := flag.String("aliases", "", "comma separated list of device aliases used by the {alias} topic field, in the alias=schema/device_type/device_id format")
+	xplConfigFile := flag.String("xpl-config-file", "xpl2mqtt-config.json", "file storing the configuration received from the xpl network, empty to disable")
+	xplWaitConfig := flag.Bool("xpl-wait-config", false, "wait for the configuration from the xpl network before being operational")
+	xplInstance := flag.String("xpl-instance", "", "xpl instance id of the bridge (defaults to the client id)")
+	generic := flag.Bool("generic-decoder", true, "publish the body of xpl schemas without a dedicated decoder")
+	txSpacing := flag.Duration("tx-spacing", 100*time.Millisecond, "minimum delay between two transmitted xpl packets")
+	txQueueSize := flag.Int("tx-queue-size", 100, "maximum number of xpl packets waiting to be sent, repeats included")
+	dedupWindow := flag.Duration("dedup-window", time.Second, "identical xpl packets received during this window are ignored, 0 to disable")
+	raw := flag.Bool("raw", false, "publish every xpl packet as json and accept raw xpl commands")
+	genericExclude := flag.String("generic-decoder-exclude", "", "comma separated list of xpl schemas ignored by the generic decoder")
 
 	envy.Parse("X2M")
 	flag.Parse()
@@ -52,6 +121,42 @@ func Parse() {
 		log.Fatalf("unable to resolve udp address: %s", err.Error())
 	}
 
+	gateways, err := parseGateways(splitList(*gws))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	routeList, err := parseRoutes(splitList(*routes), gateways)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = validateTopicTemplate(*topicTemplate)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *topicSet == "" || *topicGet == "" || *topicSet == *topicState || *topicGet == *topicState || *topicGet == *topicSet || strings.ContainsAny(*topicSet+*topicState+*topicGet, "/+#") {
+		log.Fatal("invalid topic actions: the command and get actions cannot be empty, the actions must be different, and they cannot contain /, + or #")
+	}
+	aliasList, err := parseAliases(splitList(*aliases))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	excluded := []string{}
+	for _, e := range splitList(*optimisticExclude) {
+		pattern, err := devicePattern(e)
+		if err != nil {
+			log.Fatalf("invalid optimistic exclusion %q: %s", e, err.Error())
+		}
+		excluded = append(excluded, pattern)
+	}
+
+	if *xplMode != "standalone" && *xplMode != "hub" && *xplMode != "client" {
+		log.Fatalf("invalid xpl mode: %s", *xplMode)
+	}
+
+	if *xplInstance == "" {
+		*xplInstance = instanceID(*id)
+	}
+
 	logLevel := new(slog.LevelVar)
 	switch *level {
 	case "debug":
@@ -70,16 +175,78 @@ func Parse() {
 	slog.SetDefault(slog.New(handler))
 
 	ConfigData = Config{
-		BroadcastAddress: addr,
-		Retries:          *retries,
-		MqttBroker:       *mqttBroker,
-		MqttUsername:     *mqttUser,
-		MqttPassword:     *mqttPass,
-		MqttVerifySSL:    *mqttSsl,
-		ClientID:         *id,
-		MqttBaseTopic:    *mqttBaseTopic,
-		HassDiscovery:    *hass,
-		XPLHops:          *xplHops,
-		XPLTarget:        *xplTarget,
+		BroadcastAddress:  addr,
+		Retries:           *retries,
+		MqttBroker:        *mqttBroker,
+		MqttUsername:      *mqttUser,
+		MqttPassword:      *mqttPass,
+		MqttVerifySSL:     *mqttSsl,
+		ClientID:          *id,
+		MqttBaseTopic:     *mqttBaseTopic,
+		HassDiscovery:     *hass,
+		XPLHops:           *xplHops,
+		XPLTarget:         *xplTarget,
+		XPLInstance:       *xplInstance,
+		XPLMode:           *xplMode,
+		XPLInterval:       *xplInterval,
+		XPLGroups:         splitList(strings.ToLower(*xplGroups)),
+		XPLFilters:        splitList(strings.ToLower(*xplFilters)),
+		XPLConfigFile:     *xplConfigFile,
+		XPLWaitConfig:     *xplWaitConfig,
+		XPLInterfaces:     splitList(*xplInterfaces),
+		XPLIPv6:           *xplIPv6,
+		XPLMulticastGroup: *xplGroup,
+		GatewayDiscovery:  *gwDiscovery,
+		GatewaySource:     strings.ToLower(*gwSource),
+		Gateways:          gateways,
+		Routes:            routeList,
+		TopicTemplate:     *topicTemplate,
+		TopicState:        *topicState,
+		TopicSet:          *topicSet,
+		TopicGet:          *topicGet,
+		Aliases:           aliasList,
+		JsonState:         *jsonState,
+		StateFile:         *stateFile,
+		OptimisticSchemas: splitList(*optimistic),
+		OptimisticExclude: excluded,
+		CommandTimeout:    *commandTimeout,
+		ReassertSchemas:   splitList(*reassert),
+		ReassertInterval:  *reassertInterval,
+		ReassertCount:     *reassertCount,
+		ReassertOnStart:   *reassertOnStart,
+		GenericDecoder:    *generic,
+		GenericExclude:    splitList(*genericExclude),
+		Raw:               *raw,
+		DedupWindow:       *dedupWindow,
+		TxSpacing:         *txSpacing,
+		TxQueueSize:       *txQueueSize,
+	}
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// converts an identifier to a valid xpl instance id: lowercase letters, digits and hyphens, max 16 chars
+func instanceID(id string) string {
+	res := ""
+	for _, c := range strings.ToLower(id) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			res += string(c)
+		}
+	}
+	if len(res) > 16 {
+		res = res[:16]
+	}
+	if res == "" {
+		res = "default"
 	}
+	return res
 }
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+type Gateway struct {
+	Name   string
+	Source string // xpl source, learned from the received packets if empty
+	Addr   *net.UDPAddr
+}
+
+// commands whose topic matches Pattern (schema/device_type/device_id) are sent through Gateway
+type Route struct {
+	Pattern string
+	Gateway string
+}
+
+// parses a list of name=[source@]host[:port]
+func parseGateways(list []string) ([]Gateway, error) {
+	res := []Gateway{}
+	for _, g := range list {
+		name, addr, found := strings.Cut(g, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid gateway %q, expected name=[source@]host[:port]", g)
+		}
+		source := ""
+		if s, a, found := strings.Cut(addr, "@"); found {
+			source = strings.ToLower(s)
+			addr = a
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "3865")
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %q: %w", g, err)
+		}
+		res = append(res, Gateway{Name: name, Source: source, Addr: udpAddr})
+	}
+	return res, nil
+}
+
+// parses a list of pattern=gateway, missing segments of the pattern match any value
+func parseRoutes(list []string, gateways []Gateway) ([]Route, error) {
+	res := []Route{}
+	for _, r := range list {
+		pattern, gw, found := strings.Cut(r, "=")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("invalid route %q, expected schema[/device_type[/device_id]]=gateway", r)
+		}
+		pattern, err := devicePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", r, err)
+		}
+		known := false
+		for _, g := range gateways {
+			known = known || g.Name == gw
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid route %q: unknown gateway %s", r, gw)
+		}
+		res = append(res, Route{Pattern: pattern, Gateway: gw})
+	}
+	return res, nil
+}
+
+// converts schema[/device_type[/device_id]] to a path.Match pattern, missing segments match any value
+func devicePattern(pattern string) (string, error) {
+	segments := strings.Split(pattern, "/")
+	if len(segments) > 3 {
+		return "", fmt.Errorf("expected schema[/device_type[/device_id]]")
+	}
+	for len(segments) < 3 {
+		segments = append(segments, "*")
+	}
+	pattern = strings.Join(segments, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", err
+	}
+	return pattern, nil
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// name of a device in the topics using the {alias} field
+type Alias struct {
+	Name       string
+	Schema     string
+	DeviceType string
+	DeviceID   string
+}
+
+var TopicPlaceholder = regexp.MustCompile(`\{([^}]*)\}`)
+
+var topicFields = []string{"base", "schema", "device_type", "device_id", "alias", "param", "action"}
+
+// checks that the template only uses known fields, and that the device, its parameter and the action can be parsed back
+func validateTopicTemplate(tpl string) error {
+	if strings.ContainsAny(tpl, "+#") {
+		return fmt.Errorf("invalid topic template %q: wildcards are not allowed", tpl)
+	}
+	// the commands are subscribed to under the levels before the first field, they cannot be the whole broker
+	first, _, _ := strings.Cut(tpl, "/")
+	if first != "{base}" && (first == "" || TopicPlaceholder.MatchString(first)) {
+		return fmt.Errorf("invalid topic template %q: it must start with {base} or a fixed level", tpl)
+	}
+	used := map[string]bool{}
+	for _, m := range TopicPlaceholder.FindAllStringSubmatch(tpl, -1) {
+		if !slices.Contains(topicFields, m[1]) {
+			return fmt.Errorf("invalid topic template %q: unknown field {%s}", tpl, m[1])
+		}
+		if used[m[1]] {
+			return fmt.Errorf("invalid topic template %q: duplicated field {%s}", tpl, m[1])
+		}
+		used[m[1]] = true
+	}
+	if !used["param"] || !used["action"] {
+		return fmt.Errorf("invalid topic template %q: {param} and {action} are required", tpl)
+	}
+	if !used["alias"] && (!used["schema"] || !used["device_type"] || !used["device_id"]) {
+		return fmt.Errorf("invalid topic template %q: {alias} or {schema}, {device_type} and {device_id} are required", tpl)
+	}
+	return nil
+}
+
+// parses a list of alias=schema/device_type/device_id
+func parseAliases(list []string) ([]Alias, error) {
+	res := []Alias{}
+	for _, a := range list {
+		name, device, found := strings.Cut(a, "=")
+		segments := strings.Split(device, "/")
+		if !found || name == "" || len(segments) != 3 || slices.Contains(segments, "") {
+			return nil, fmt.Errorf("invalid alias %q, expected alias=schema/device_type/device_id", a)
+		}
+		if strings.ContainsAny(name, "/+#") {
+			return nil, fmt.Errorf("invalid alias %q: the name cannot contain /, + or #", a)
+		}
+		for _, r := range res {
+			if r.Name == name {
+				return nil, fmt.Errorf("duplicated alias %q", name)
+			}
+		}
+		res = append(res, Alias{Name: name, Schema: segments[0], DeviceType: segments[1], DeviceID: segments[2]})
+	}
+	return res, nil
+}
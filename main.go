@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/droso-hass/xpl2mqtt/cmd"
 	"github.com/droso-hass/xpl2mqtt/utils"
@@ -11,9 +16,15 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// maximum time spent waiting for the mqtt messages on shutdown
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	cmd.Parse()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	opts := mqtt.NewClientOptions()
 	opts.SetOrderMatters(false)
 	opts.SetAutoReconnect(true)
@@ -22,29 +33,50 @@ func main() {
 	opts.SetUsername(cmd.ConfigData.MqttUsername)
 	opts.SetPassword(cmd.ConfigData.MqttPassword)
 	opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: cmd.ConfigData.MqttVerifySSL})
+	// the broker publishes offline if the bridge disconnects without stopping
+	opts.SetWill(xpl.BridgeStateTopic(), "offline", 1, true)
+
+	var srv *xpl.Server
+	// subscriptions are made again on each reconnection as the session is not kept by the broker
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		if cmd.ConfigData.HassDiscovery {
+			mqttDisc := c.Subscribe("homeassistant/+/xpl2mqtt/+/config", 0, xpl.ProcessMqttDiscovery)
+			if utils.MqttError(mqttDisc) != nil {
+				return
+			}
+		}
+
+		for _, t := range xpl.CommandSubscriptions() {
+			mqttCmd := c.Subscribe(t, 0, func(c mqtt.Client, m mqtt.Message) { xpl.ProcessMqtt(c, m, srv) })
+			if utils.MqttError(mqttCmd) != nil {
+				return
+			}
+		}
+
+		utils.MqttError(c.Publish(xpl.BridgeStateTopic(), 1, true, "online"))
+		slog.Info("connected to the mqtt broker")
+	})
 
 	client := mqtt.NewClient(opts)
-	srv := xpl.NewServer(xpl.XPLPort, &client)
+	srv = xpl.NewServer(xpl.XPLPort, &client, cmd.ConfigData.XPLMode)
 
 	err := utils.MqttError(client.Connect())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if cmd.ConfigData.HassDiscovery {
-		mqttDisc := client.Subscribe("homeassistant/+/xpl2mqtt/+/config", 0, xpl.ProcessMqttDiscovery)
-		err = utils.MqttError(mqttDisc)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	mqttCmd := client.Subscribe(cmd.ConfigData.MqttBaseTopic+"/#", 0, func(c mqtt.Client, m mqtt.Message) { xpl.ProcessMqtt(c, m, srv) })
-	err = utils.MqttError(mqttCmd)
+	slog.Info("xpl2mqtt started")
+	err = srv.Run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	slog.Info("xpl2mqtt started")
-	srv.Run()
+	// no more commands are accepted, the last messages are sent before disconnecting
+	utils.MqttError(client.Unsubscribe(xpl.CommandSubscriptions()...))
+	if !xpl.WaitPublished(shutdownTimeout) {
+		slog.Warn("some mqtt messages were not sent before shutdown")
+	}
+	utils.MqttError(client.Publish(xpl.BridgeStateTopic(), 1, true, "offline"))
+	client.Disconnect(250)
+	slog.Info("xpl2mqtt stopped")
 }
@@ -0,0 +1,159 @@
+package xpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// body of a xpl message, keys keep their insertion order and may be repeated
+type Body []KeyValue
+
+// returns the first value of key, or an empty string
+func (b Body) Get(key string) string {
+	v, _ := b.Lookup(key)
+	return v
+}
+
+// returns the first value of key and whether it was found
+func (b Body) Lookup(key string) (string, bool) {
+	for _, kv := range b {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return "", false
+}
+
+// returns every value of key, in order
+func (b Body) GetAll(key string) []string {
+	res := []string{}
+	for _, kv := range b {
+		if kv.Key == key {
+			res = append(res, kv.Value)
+		}
+	}
+	return res
+}
+
+func (b Body) Has(key string) bool {
+	_, ok := b.Lookup(key)
+	return ok
+}
+
+// returns the keys of the body, in order and without duplicates
+func (b Body) Keys() []string {
+	res := []string{}
+	for _, kv := range b {
+		if !slices.Contains(res, kv.Key) {
+			res = append(res, kv.Key)
+		}
+	}
+	return res
+}
+
+// appends a value to key, keeping the existing ones
+func (b *Body) Add(key string, value string) {
+	*b = append(*b, KeyValue{Key: key, Value: value})
+}
+
+// replaces the value of key at the position of its first occurrence, removing the other ones
+// the value is appended if key is not in the body
+func (b *Body) Set(key string, value string) {
+	res := Body{}
+	found := false
+	for _, kv := range *b {
+		if kv.Key != key {
+			res = append(res, kv)
+		} else if !found {
+			res = append(res, KeyValue{Key: key, Value: value})
+			found = true
+		}
+	}
+	if !found {
+		res = append(res, KeyValue{Key: key, Value: value})
+	}
+	*b = res
+}
+
+// removes every value of key
+func (b *Body) Del(key string) {
+	*b = slices.DeleteFunc(*b, func(kv KeyValue) bool { return kv.Key == key })
+}
+
+// encodes the body as a json object, keeping the order and the repeated keys
+func (b Body) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, kv := range b {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodes a json object, keeping the order and the repeated keys
+// numbers and booleans are converted to strings
+func (b *Body) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		*b = nil
+		return nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return errors.New("xpl body must be a json object")
+	}
+	res := Body{}
+	for dec.More() {
+		t, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key := t.(string)
+		t, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		switch v := t.(type) {
+		case string:
+			res.Add(key, v)
+		case json.Number:
+			res.Add(key, v.String())
+		case bool:
+			res.Add(key, fmt.Sprint(v))
+		default:
+			return fmt.Errorf("invalid value for xpl body key %q", key)
+		}
+	}
+	_, err = dec.Token()
+	if err != nil {
+		return err
+	}
+	*b = res
+	return nil
+}
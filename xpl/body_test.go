@@ -0,0 +1,127 @@
+package xpl
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestBodyMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body Body
+		json string
+	}{
+		{"nil", nil, `{}`},
+		{"ordered", Body{{"unit", "1"}, {"command", "on"}, {"address", "0x1"}}, `{"unit":"1","command":"on","address":"0x1"}`},
+		{"repeated keys", Body{{"group", "a"}, {"group", "b"}}, `{"group":"a","group":"b"}`},
+		{"value containing =", Body{{"text", "a=b"}}, `{"text":"a=b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := json.Marshal(tt.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(res) != tt.json {
+				t.Errorf("got %s, want %s", res, tt.json)
+			}
+		})
+	}
+}
+
+func TestBodyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		body    Body
+		wantErr bool
+	}{
+		{"ordered", `{"unit":"1","command":"on"}`, Body{{"unit", "1"}, {"command", "on"}}, false},
+		{"repeated keys", `{"group":"a","group":"b"}`, Body{{"group", "a"}, {"group", "b"}}, false},
+		{"numbers", `{"level":50,"temp":-1.5,"big":12345678901234567890}`, Body{{"level", "50"}, {"temp", "-1.5"}, {"big", "12345678901234567890"}}, false},
+		{"bools", `{"a":true,"b":false}`, Body{{"a", "true"}, {"b", "false"}}, false},
+		{"empty", `{}`, Body{}, false},
+		{"null", `null`, nil, false},
+		{"array", `["a"]`, nil, true},
+		{"string", `"a"`, nil, true},
+		{"nested object", `{"a":{"b":"c"}}`, nil, true},
+		{"null value", `{"a":null}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Body
+			err := json.Unmarshal([]byte(tt.json), &b)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !slices.Equal(b, tt.body) {
+				t.Errorf("got %v, want %v", b, tt.body)
+			}
+		})
+	}
+}
+
+func TestBodyJSONRoundTrip(t *testing.T) {
+	body := Body{{"group", "b"}, {"unit", "1"}, {"group", "a"}, {"text", "x=y"}}
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var res Body
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !slices.Equal(res, body) {
+		t.Errorf("got %v, want %v", res, body)
+	}
+}
+
+func TestBodyAccessors(t *testing.T) {
+	body := Body{{"group", "a"}, {"unit", "1"}, {"group", "b"}}
+	if body.Get("group") != "a" {
+		t.Errorf("Get returned %q, want the first value", body.Get("group"))
+	}
+	if _, ok := body.Lookup("missing"); ok {
+		t.Errorf("Lookup found a missing key")
+	}
+	if v := body.GetAll("group"); !slices.Equal(v, []string{"a", "b"}) {
+		t.Errorf("GetAll returned %v", v)
+	}
+	if v := body.GetAll("missing"); v == nil || len(v) != 0 {
+		t.Errorf("GetAll returned %#v for a missing key, want an empty slice", v)
+	}
+	if v := body.Keys(); !slices.Equal(v, []string{"group", "unit"}) {
+		t.Errorf("Keys returned %v", v)
+	}
+}
+
+func TestBodyUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(*Body)
+		body   Body
+	}{
+		{"add repeats a key", func(b *Body) { b.Add("group", "c") }, Body{{"group", "a"}, {"unit", "1"}, {"group", "b"}, {"group", "c"}}},
+		{"set replaces every occurrence", func(b *Body) { b.Set("group", "c") }, Body{{"group", "c"}, {"unit", "1"}}},
+		{"set appends a missing key", func(b *Body) { b.Set("command", "on") }, Body{{"group", "a"}, {"unit", "1"}, {"group", "b"}, {"command", "on"}}},
+		{"del removes every occurrence", func(b *Body) { b.Del("group") }, Body{{"unit", "1"}}},
+		{"del of a missing key", func(b *Body) { b.Del("missing") }, Body{{"group", "a"}, {"unit", "1"}, {"group", "b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := Body{{"group", "a"}, {"unit", "1"}, {"group", "b"}}
+			tt.update(&body)
+			if !slices.Equal(body, tt.body) {
+				t.Errorf("got %v, want %v", body, tt.body)
+			}
+		})
+	}
+}
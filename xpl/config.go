@@ -0,0 +1,246 @@
+package xpl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// configuration received through config.response, stored in cmd.XPLConfigFile
+type remoteConfig struct {
+	Instance string   `json:"newconf"`
+	Interval int      `json:"interval"`
+	Groups   []string `json:"group"`
+	Filters  []string `json:"filter"`
+	Retries  int      `json:"retries"`
+	Hops     int      `json:"hops"`
+}
+
+// maximum number of values of the multi-valued items
+const maxConfigValues = 16
+
+// configuration in use, nil until a configuration is loaded or received
+// it is replaced as a whole, cmd.ConfigData only holds the values of the command line
+var appliedConfig atomic.Pointer[remoteConfig]
+
+func currentConfig() remoteConfig {
+	if c := appliedConfig.Load(); c != nil {
+		return *c
+	}
+	return remoteConfig{
+		Instance: cmd.ConfigData.XPLInstance,
+		Interval: cmd.ConfigData.XPLInterval,
+		Groups:   cmd.ConfigData.XPLGroups,
+		Filters:  cmd.ConfigData.XPLFilters,
+		Retries:  cmd.ConfigData.Retries,
+		Hops:     cmd.ConfigData.XPLHops,
+	}
+}
+
+func (c remoteConfig) source() string {
+	return fmt.Sprintf("xpl2mqtt-bridge.%s", c.Instance)
+}
+
+func (c remoteConfig) apply() {
+	appliedConfig.Store(&c)
+}
+
+func (c remoteConfig) validate() error {
+	if err := validateName("instance", c.Instance, maxInstanceLen, true); err != nil {
+		return err
+	}
+	if c.Interval < 1 || c.Interval > 30 {
+		return errors.New("interval must be between 1 and 30 minutes")
+	}
+	if c.Retries < 1 || c.Retries > 10 {
+		return errors.New("retries must be between 1 and 10")
+	}
+	if c.Hops < 1 || c.Hops > maxHop {
+		return errors.New("hops must be between 1 and 9")
+	}
+	if len(c.Groups) > maxConfigValues || len(c.Filters) > maxConfigValues {
+		return errors.New("too many groups or filters")
+	}
+	for _, g := range c.Groups {
+		if err := validateGroup(g); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.Filters {
+		if err := validateFilter(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loads the stored configuration, returns false if there is none
+func loadConfig() bool {
+	if cmd.ConfigData.XPLConfigFile == "" {
+		return false
+	}
+	data, err := os.ReadFile(cmd.ConfigData.XPLConfigFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("error reading xpl config file", "error", err.Error())
+		}
+		return false
+	}
+	c := currentConfig()
+	err = json.Unmarshal(data, &c)
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		slog.Error("invalid xpl config file", "error", err.Error())
+		return false
+	}
+	c.apply()
+	slog.Info("xpl config loaded", "file", cmd.ConfigData.XPLConfigFile)
+	return true
+}
+
+func saveConfig() {
+	if cmd.ConfigData.XPLConfigFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(currentConfig(), "", "  ")
+	if err != nil {
+		slog.Error("error encoding xpl config", "error", err.Error())
+		return
+	}
+	err = os.WriteFile(cmd.ConfigData.XPLConfigFile, data, 0644)
+	if err != nil {
+		slog.Error("error writing xpl config file", "error", err.Error())
+	}
+}
+
+// handles the config.list, config.current and config.response commands sent by xpl management tools
+func (p *Server) processConfig(pkt *XPLPacket) {
+	if pkt.Type != TypeCmnd || !strings.HasPrefix(pkt.MessageType, "config.") {
+		return
+	}
+	switch pkt.MessageType {
+	case "config.list":
+		if pkt.Data.Get("command") == "request" && acceptsConfig(pkt) {
+			p.sendConfig("config.list", configList())
+		}
+	case "config.current":
+		if pkt.Data.Get("command") == "request" && acceptsConfig(pkt) {
+			p.sendConfig("config.current", configCurrent())
+		}
+	case "config.response":
+		// a configuration is only accepted when sent to the bridge
+		if pkt.Target == XPLSource() {
+			p.processConfigResponse(pkt)
+		}
+	}
+}
+
+// config requests sent directly to the bridge bypass the filters, so that a wrong filter can still be fixed
+func acceptsConfig(pkt *XPLPacket) bool {
+	return pkt.Target == XPLSource() || Accepts(pkt)
+}
+
+func configList() Body {
+	data := Body{}
+	data.Add("reconf", "newconf")
+	data.Add("option", "interval")
+	data.Add("option", "group["+strconv.Itoa(maxConfigValues)+"]")
+	data.Add("option", "filter["+strconv.Itoa(maxConfigValues)+"]")
+	data.Add("option", "retries")
+	data.Add("option", "hops")
+	return data
+}
+
+func configCurrent() Body {
+	c := currentConfig()
+	data := Body{}
+	data.Add("newconf", c.Instance)
+	data.Add("interval", strconv.Itoa(c.Interval))
+	addValues(&data, "group", c.Groups)
+	addValues(&data, "filter", c.Filters)
+	data.Add("retries", strconv.Itoa(c.Retries))
+	data.Add("hops", strconv.Itoa(c.Hops))
+	return data
+}
+
+// empty multi-valued items are sent with an empty value
+func addValues(data *Body, key string, values []string) {
+	if len(values) == 0 {
+		data.Add(key, "")
+	}
+	for _, v := range values {
+		data.Add(key, v)
+	}
+}
+
+func (p *Server) processConfigResponse(pkt *XPLPacket) {
+	c := currentConfig()
+	var err error
+	for _, key := range pkt.Data.Keys() {
+		switch key {
+		case "newconf":
+			c.Instance = strings.ToLower(pkt.Data.Get(key))
+		case "interval":
+			c.Interval, err = strconv.Atoi(pkt.Data.Get(key))
+		case "group":
+			c.Groups = nonEmpty(pkt.Data.GetAll(key))
+		case "filter":
+			c.Filters = nonEmpty(pkt.Data.GetAll(key))
+		case "retries":
+			c.Retries, err = strconv.Atoi(pkt.Data.Get(key))
+		case "hops":
+			c.Hops, err = strconv.Atoi(pkt.Data.Get(key))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		slog.Error("invalid xpl config received", "source", pkt.Source, "error", err.Error())
+		return
+	}
+
+	c.apply()
+	saveConfig()
+	p.configured.Store(true)
+	slog.Info("xpl config received", "source", pkt.Source, "config", c)
+	p.sendHeartbeat()
+}
+
+func nonEmpty(values []string) []string {
+	res := []string{}
+	for _, v := range values {
+		if v != "" {
+			res = append(res, strings.ToLower(v))
+		}
+	}
+	return res
+}
+
+func (p *Server) sendConfig(schema string, data Body) {
+	pkt := XPLPacket{
+		Type:        TypeStat,
+		Hop:         currentConfig().Hops,
+		Source:      XPLSource(),
+		Target:      "*",
+		MessageType: schema,
+		Data:        data,
+	}
+	slog.Debug("sending xpl config", "packet", pkt)
+	err := p.WritePriority(&pkt, broadcastAddr, 1, PriorityLow)
+	if err != nil {
+		slog.Error("error sending xpl config", "error", err.Error())
+	}
+}
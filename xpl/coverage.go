@@ -0,0 +1,113 @@
+package xpl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// how often the rf coverage is published
+const coverageInterval = time.Minute
+
+// devices whose receptions changed since the last publication, by deviceKey
+var coverageChanged = map[string]bool{}
+
+// gateways which heard a device
+type deviceCoverage struct {
+	HeardBy    []string             `json:"heard_by"`
+	Receptions map[string]reception `json:"receptions"`
+}
+
+// packets received from a gateway
+type gatewayCoverage struct {
+	Source   string `json:"source,omitempty"`
+	IP       string `json:"ip"`
+	Received int    `json:"received"`
+}
+
+// <base>/coverage/<schema>/<device_id>
+func CoverageTopic(key string) string {
+	return fmt.Sprintf("%s/coverage/%s", cmd.ConfigData.MqttBaseTopic, key)
+}
+
+func GatewaysTopic() string {
+	return fmt.Sprintf("%s/bridge/gateways", cmd.ConfigData.MqttBaseTopic)
+}
+
+func hasCoverage(key string) bool {
+	gatewaysLock.Lock()
+	defer gatewaysLock.Unlock()
+	_, ok := deviceGateways[key]
+	return ok
+}
+
+// xpl sources of the gateways which heard the device, empty if it was not heard by a gateway
+func deviceReceivers(key string) []string {
+	gatewaysLock.Lock()
+	defer gatewaysLock.Unlock()
+	res := []string{}
+	for name := range deviceGateways[key] {
+		if g, ok := gateways[name]; ok && g.source != "" {
+			res = append(res, g.source)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// publishes the coverage of the devices which were received since the last call, and the reception counts of the gateways
+func publishCoverage(c *mqtt.Client) {
+	gatewaysLock.Lock()
+	if len(coverageChanged) == 0 {
+		gatewaysLock.Unlock()
+		return
+	}
+	devs := map[string]deviceCoverage{}
+	for key := range coverageChanged {
+		cov := deviceCoverage{HeardBy: []string{}, Receptions: map[string]reception{}}
+		for name, r := range deviceGateways[key] {
+			cov.HeardBy = append(cov.HeardBy, name)
+			cov.Receptions[name] = *r
+		}
+		slices.Sort(cov.HeardBy)
+		devs[key] = cov
+	}
+	clear(coverageChanged)
+	gws := map[string]gatewayCoverage{}
+	for name, g := range gateways {
+		gws[name] = gatewayCoverage{Source: g.source, IP: g.addr.IP.String(), Received: g.received}
+	}
+	gatewaysLock.Unlock()
+
+	for key, cov := range devs {
+		data, err := json.Marshal(cov)
+		if err != nil {
+			slog.Error("error encoding device coverage", "error", err.Error())
+			continue
+		}
+		sendMqttPacketRetained(c, CoverageTopic(key), string(data))
+	}
+	data, err := json.Marshal(gws)
+	if err != nil {
+		slog.Error("error encoding gateways coverage", "error", err.Error())
+		return
+	}
+	sendMqttPacketRetained(c, GatewaysTopic(), string(data))
+}
+
+func watchCoverage(ctx context.Context, c *mqtt.Client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(coverageInterval):
+		}
+		publishCoverage(c)
+	}
+}
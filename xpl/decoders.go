@@ -1,11 +1,16 @@
 package xpl
 
 import (
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/droso-hass/xpl2mqtt/cmd"
 	"github.com/droso-hass/xpl2mqtt/utils"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -13,6 +18,8 @@ import (
 var decoders = map[string](func(pkt *XPLPacket, mqtt *mqtt.Client)){
 	"log.basic":    decodeLogs,
 	"hbeat.basic":  decodeHbeat,
+	"hbeat.app":    decodeHbeat,
+	"hbeat.end":    decodeHbeatEnd,
 	"x10.basic":    decodeX10,
 	"ac.basic":     decodeAC,
 	"x10.security": decodeX10Sec,
@@ -28,41 +35,143 @@ var x10secCmdToState = map[string]string{
 	"normal":   "armed_home", // not sure about this one
 }
 
+// number of mqtt messages which are not yet acknowledged by the broker
+// a counter is used instead of a WaitGroup as messages can still be published while waiting
+var pendingPublish int
+var pendingPublishLock sync.Mutex
+var publishedCond = sync.NewCond(&pendingPublishLock)
+
 func sendMqttPacket(client *mqtt.Client, topic string, data string) {
 	x := (*client).Publish(topic, 1, false, data)
 	slog.Debug("sending mqtt packet", "topic", topic, "message", data)
-	go utils.MqttError(x)
+	waitMqttPacket(x)
+}
+
+func sendMqttPacketRetained(client *mqtt.Client, topic string, data string) {
+	x := (*client).Publish(topic, 1, true, data)
+	slog.Debug("sending retained mqtt packet", "topic", topic, "message", data)
+	waitMqttPacket(x)
+}
+
+func waitMqttPacket(t mqtt.Token) {
+	pendingPublishLock.Lock()
+	pendingPublish++
+	pendingPublishLock.Unlock()
+	go func() {
+		utils.MqttError(t)
+		pendingPublishLock.Lock()
+		pendingPublish--
+		if pendingPublish == 0 {
+			publishedCond.Broadcast()
+		}
+		pendingPublishLock.Unlock()
+	}()
+}
+
+// waits until every mqtt message has been acknowledged, returns false on timeout
+func WaitPublished(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pendingPublishLock.Lock()
+		for pendingPublish > 0 {
+			publishedCond.Wait()
+		}
+		pendingPublishLock.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
+// schemas already handled by the generic decoder, used to only log them once
+var genericSchemas = map[string]bool{}
+var genericSchemasLock sync.Mutex
+
 func ProcessXPL(pkt *XPLPacket, mqtt *mqtt.Client) {
+	// packets sent by the bridge are received back because they are broadcasted
+	if pkt.Source == XPLSource() {
+		return
+	}
+	fromGateway := recordGateway(pkt)
+	confirmRequests(pkt)
+	if isDuplicate(pkt, fromGateway) {
+		slog.Debug("duplicated xpl packet ignored", "packet", *pkt)
+		return
+	}
 	slog.Debug("received xpl packet", "packet", *pkt)
-	dec, _ := decoders[pkt.MessageType]
+	if cmd.ConfigData.Raw {
+		sendRawPacket(pkt, mqtt)
+	}
+	dec, ok := decoders[pkt.MessageType]
+	if !ok {
+		if !cmd.ConfigData.GenericDecoder || slices.Contains(cmd.ConfigData.GenericExclude, pkt.MessageType) {
+			slog.Debug("no decoder for xpl message type", "type", pkt.MessageType)
+			return
+		}
+		genericSchemasLock.Lock()
+		if !genericSchemas[pkt.MessageType] {
+			genericSchemas[pkt.MessageType] = true
+			slog.Info("no decoder for xpl message type, using the generic decoder", "type", pkt.MessageType, "source", pkt.Source)
+		}
+		genericSchemasLock.Unlock()
+		dec = decodeGeneric
+	}
 	dec(pkt, mqtt)
+	flushStates(mqtt)
+}
+
+// publishes every key of the body to <base>/<schema>/<source>/<key>/state (with the name of the state action,
+// the level being removed when it is empty) and the whole body as json to <base>/<schema>/<source>/json
+func decodeGeneric(pkt *XPLPacket, c *mqtt.Client) {
+	base := fmt.Sprintf("%s/%s/%s", cmd.ConfigData.MqttBaseTopic, pkt.MessageType, pkt.Source)
+	state := ""
+	if name := actionName("state"); name != "" {
+		state = "/" + name
+	}
+	for _, kv := range pkt.Data {
+		sendMqttPacket(c, base+"/"+kv.Key+state, kv.Value)
+	}
+	data, err := json.Marshal(pkt.Data)
+	if err != nil {
+		slog.Error("error encoding xpl packet body", "error", err.Error())
+		return
+	}
+	sendMqttPacket(c, base+"/json", string(data))
 }
 
 func decodeLogs(pkt *XPLPacket, mqtt *mqtt.Client) {
-	tp, ok := pkt.Data["type"]
+	tp, ok := pkt.Data.Lookup("type")
 	if ok {
 		if tp == "inf" {
-			slog.Info("xpl log received", "message", pkt.Data["text"], "code", pkt.Data["code"])
+			slog.Info("xpl log received", "message", pkt.Data.Get("text"), "code", pkt.Data.Get("code"))
 		} else if tp == "wrn" {
-			slog.Warn("xpl log received", "message", pkt.Data["text"], "code", pkt.Data["code"])
+			slog.Warn("xpl log received", "message", pkt.Data.Get("text"), "code", pkt.Data.Get("code"))
 		} else if tp == "err" {
-			slog.Error("xpl log received", "message", pkt.Data["text"], "code", pkt.Data["code"])
+			slog.Error("xpl log received", "message", pkt.Data.Get("text"), "code", pkt.Data.Get("code"))
 		}
 	}
 }
 
 func decodeHbeat(pkt *XPLPacket, mqtt *mqtt.Client) {
-	slog.Debug("xpl heartbeat", "interval", pkt.Data["interval"], "version", pkt.Data["version"], "ip", pkt.Data["ip"])
+	slog.Debug("xpl heartbeat", "source", pkt.Source, "interval", pkt.Data.Get("interval"), "version", pkt.Data.Get("version"), "ip", pkt.Data.Get("ip"))
+	updateDevice(pkt, mqtt)
+}
+
+func decodeHbeatEnd(pkt *XPLPacket, mqtt *mqtt.Client) {
+	slog.Debug("xpl heartbeat end", "source", pkt.Source)
+	removeDevice(pkt.Source, mqtt)
 }
 
 func decodeX10(pkt *XPLPacket, c *mqtt.Client) {
-	dev, ok := pkt.Data["device"]
+	dev, ok := pkt.Data.Lookup("device")
 	if !ok {
 		return
 	}
-	command, ok := pkt.Data["command"]
+	command, ok := pkt.Data.Lookup("command")
 	if !ok {
 		return
 	}
@@ -103,20 +212,20 @@ func decodeX10(pkt *XPLPacket, c *mqtt.Client) {
 		},
 		UniqueID: "x2m" + pkt.MessageType + dev + topic.DeviceParam,
 	}
-	sendHassPacket(c, "switch", dev, cfg)
-	sendMqttPacket(c, topic.String(), state)
+	sendHassPacket(c, pkt, "switch", dev, cfg)
+	publishState(c, pkt, topic, state)
 }
 
 func decodeAC(pkt *XPLPacket, c *mqtt.Client) {
-	addr, ok := pkt.Data["address"]
+	addr, ok := pkt.Data.Lookup("address")
 	if !ok {
 		return
 	}
-	unit, ok := pkt.Data["unit"]
+	unit, ok := pkt.Data.Lookup("unit")
 	if !ok {
 		return
 	}
-	command, ok := pkt.Data["command"]
+	command, ok := pkt.Data.Lookup("command")
 	if !ok {
 		return
 	}
@@ -145,31 +254,37 @@ func decodeAC(pkt *XPLPacket, c *mqtt.Client) {
 		cfg.BrightnessStateTopic = topic.StringO(Topic{DeviceParam: "brightness"})
 		cfg.BrightnessCommandTopic = ct
 		cfg.UniqueID += "brightness"
-		sendHassPacket(c, "light", addr+unit, cfg)
-		sendMqttPacket(c, topic.String(), "ON")
-		level, ok := pkt.Data["level"]
+		sendHassPacket(c, pkt, "light", addr+unit, cfg)
+		publishState(c, pkt, topic, "ON")
+		level, ok := pkt.Data.Lookup("level")
 		if ok {
-			sendMqttPacket(c, ct, level)
+			publishState(c, pkt, Topic{
+				MessageType: topic.MessageType,
+				DeviceID:    addr,
+				DeviceType:  unit,
+				DeviceParam: "brightness",
+				Action:      "state",
+			}, level)
 		}
 	} else if command == "on" {
-		sendHassPacket(c, "switch", addr+unit, cfg)
-		sendMqttPacket(c, topic.String(), "ON")
+		sendHassPacket(c, pkt, "switch", addr+unit, cfg)
+		publishState(c, pkt, topic, "ON")
 	} else {
-		sendHassPacket(c, "switch", addr+unit, cfg)
-		sendMqttPacket(c, topic.String(), "OFF")
+		sendHassPacket(c, pkt, "switch", addr+unit, cfg)
+		publishState(c, pkt, topic, "OFF")
 	}
 }
 
 func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
-	dev, ok := pkt.Data["device"]
+	dev, ok := pkt.Data.Lookup("device")
 	if !ok {
 		return
 	}
-	tp, ok := pkt.Data["type"]
+	tp, ok := pkt.Data.Lookup("type")
 	if !ok {
 		tp = "unknown"
 	}
-	command, ok := pkt.Data["command"]
+	command, ok := pkt.Data.Lookup("command")
 	if !ok {
 		return
 	}
@@ -194,12 +309,12 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 		Device:     device,
 		UniqueID:   uid + "battery",
 	}
-	sendHassPacket(c, "binary_sensor", dev, cfg)
-	low, found := pkt.Data["low-battery"]
+	sendHassPacket(c, pkt, "binary_sensor", dev, cfg)
+	low, found := pkt.Data.Lookup("low-battery")
 	if found && low == "true" {
-		sendMqttPacket(c, topic.String(), "ON")
+		publishState(c, pkt, topic, "ON")
 	} else {
-		sendMqttPacket(c, topic.String(), "OFF")
+		publishState(c, pkt, topic, "OFF")
 	}
 
 	// tamper
@@ -209,12 +324,12 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 		Device:     device,
 		UniqueID:   uid + "tamper",
 	}
-	sendHassPacket(c, "binary_sensor", dev, cfg)
-	tamper, found := pkt.Data["tamper"]
+	sendHassPacket(c, pkt, "binary_sensor", dev, cfg)
+	tamper, found := pkt.Data.Lookup("tamper")
 	if found && tamper == "true" {
-		sendMqttPacket(c, topic.String(), "ON")
+		publishState(c, pkt, topic, "ON")
 	} else {
-		sendMqttPacket(c, topic.String(), "OFF")
+		publishState(c, pkt, topic, "OFF")
 	}
 
 	// command
@@ -231,8 +346,8 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 			CodeTriggerRequired: false,
 			UniqueID:            uid + "alarm",
 		}
-		sendHassPacket(c, "alarm_control_panel", dev, cfg)
-		sendMqttPacket(c, topic.String(), x10secCmdToState[command])
+		sendHassPacket(c, pkt, "alarm_control_panel", dev, cfg)
+		publishState(c, pkt, topic, x10secCmdToState[command])
 
 		topic.DeviceParam = "triggered"
 		cfg = HAConfig{
@@ -240,11 +355,11 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 			Device:     device,
 			UniqueID:   uid + "triggered",
 		}
-		sendHassPacket(c, "binary_sensor", dev, cfg)
+		sendHassPacket(c, pkt, "binary_sensor", dev, cfg)
 		if command == "alert" || command == "panic" || command == "motion" {
-			sendMqttPacket(c, topic.String(), "ON")
+			publishState(c, pkt, topic, "ON")
 		} else {
-			sendMqttPacket(c, topic.String(), "OFF")
+			publishState(c, pkt, topic, "OFF")
 		}
 
 	case "light", "dark":
@@ -254,11 +369,11 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 			Device:     device,
 			UniqueID:   uid + "brightness",
 		}
-		sendHassPacket(c, "binary_sensor", dev, cfg)
+		sendHassPacket(c, pkt, "binary_sensor", dev, cfg)
 		if command == "light" {
-			sendMqttPacket(c, topic.String(), "ON")
+			publishState(c, pkt, topic, "ON")
 		} else {
-			sendMqttPacket(c, topic.String(), "OFF")
+			publishState(c, pkt, topic, "OFF")
 		}
 
 	case "lights-on", "lights-off":
@@ -269,17 +384,17 @@ func decodeX10Sec(pkt *XPLPacket, c *mqtt.Client) {
 			Device:       device,
 			UniqueID:     uid + "switch",
 		}
-		sendHassPacket(c, "switch", dev, cfg)
+		sendHassPacket(c, pkt, "switch", dev, cfg)
 		if command == "lights-on" {
-			sendMqttPacket(c, topic.String(), "ON")
+			publishState(c, pkt, topic, "ON")
 		} else {
-			sendMqttPacket(c, topic.String(), "OFF")
+			publishState(c, pkt, topic, "OFF")
 		}
 	}
 }
 
 func decodeSensor(pkt *XPLPacket, c *mqtt.Client) {
-	dev, ok := pkt.Data["device"]
+	dev, ok := pkt.Data.Lookup("device")
 	if !ok {
 		return
 	}
@@ -290,7 +405,7 @@ func decodeSensor(pkt *XPLPacket, c *mqtt.Client) {
 		dev = s[1]
 	}
 
-	param, ok := pkt.Data["type"]
+	param, ok := pkt.Data.Lookup("type")
 	if !ok {
 		return
 	}
@@ -312,7 +427,7 @@ func decodeSensor(pkt *XPLPacket, c *mqtt.Client) {
 		StateTopic: topic.String(),
 	}
 
-	value, ok := pkt.Data["current"]
+	value, ok := pkt.Data.Lookup("current")
 	if !ok {
 		return
 	}
@@ -321,84 +436,84 @@ func decodeSensor(pkt *XPLPacket, c *mqtt.Client) {
 	case "temp", "setpoint":
 		cfg.Unit = "°C"
 		cfg.DeviceClass = "temperature"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "voltage":
 		cfg.Unit = "V"
 		cfg.DeviceClass = "voltage"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "input":
-		sendHassPacket(c, "binary_sensor", dev, cfg)
+		sendHassPacket(c, pkt, "binary_sensor", dev, cfg)
 		if value == "low" {
-			sendMqttPacket(c, topic.String(), "OFF")
+			publishState(c, pkt, topic, "OFF")
 		} else {
-			sendMqttPacket(c, topic.String(), "ON")
+			publishState(c, pkt, topic, "ON")
 		}
 	case "humidity":
 		cfg.Unit = "%"
 		cfg.DeviceClass = "humidity"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "status":
 		cfg.DeviceClass = "enum"
 		cfg.CommandTopic = cfg.StateTopic
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "pressure":
 		cfg.Unit = "hPa"
 		cfg.DeviceClass = "pressure"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "rainrate":
 		cfg.Unit = "mm/h"
 		cfg.DeviceClass = "precipitation_intensity"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "raintotal":
 		cfg.Unit = "mm"
 		cfg.DeviceClass = "precipitation"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "gust", "average_speed":
 		cfg.Unit = "m/s"
 		cfg.DeviceClass = "wind_speed"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "direction", "count", "uv":
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "battery":
 		cfg.Unit = "%"
 		cfg.DeviceClass = "battery"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "weight":
 		cfg.Unit = "kg"
 		cfg.DeviceClass = "weight"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "datetime":
-		t, err := time.Parse("20060201150405", pkt.Data["datetime"])
+		t, err := time.Parse("20060201150405", pkt.Data.Get("datetime"))
 		if err == nil {
 			cfg.DeviceClass = "timestamp"
-			sendHassPacket(c, "sensor", dev, cfg)
-			sendMqttPacket(c, topic.String(), strconv.FormatInt(t.Unix(), 10))
+			sendHassPacket(c, pkt, "sensor", dev, cfg)
+			publishState(c, pkt, topic, strconv.FormatInt(t.Unix(), 10))
 		}
 	case "current":
 		cfg.Unit = "A"
 		cfg.DeviceClass = "current"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "power":
 		cfg.Unit = "kW"
 		cfg.DeviceClass = "power"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	case "energy":
 		cfg.Unit = "kWh"
 		cfg.DeviceClass = "energy"
-		sendHassPacket(c, "sensor", dev, cfg)
-		sendMqttPacket(c, topic.String(), value)
+		sendHassPacket(c, pkt, "sensor", dev, cfg)
+		publishState(c, pkt, topic, value)
 	}
 }
@@ -0,0 +1,53 @@
+package xpl
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// last reception time of the recent packets, by packetKey
+var recentPackets = map[string]time.Time{}
+var recentPacketsLock sync.Mutex
+
+// the source is left out of the device packets sent by gateways, so that a reading received by several gateways is only published once
+// the packets of the gateways themselves (ex: their heartbeats) are kept apart
+func packetKey(pkt *XPLPacket, fromGateway bool) string {
+	source := pkt.Source
+	if fromGateway && packetDeviceID(pkt) != "" {
+		source = "gateway"
+	}
+	var sb strings.Builder
+	sb.WriteString(string(pkt.Type) + "|" + source + "|" + pkt.MessageType)
+	for _, kv := range pkt.Data {
+		sb.WriteString("|" + kv.Key + "=" + kv.Value)
+	}
+	return sb.String()
+}
+
+// whether an identical packet (same source, schema and body) was received during the dedup window
+// the window restarts on each repeat, so that a long press only produces one message
+func isDuplicate(pkt *XPLPacket, fromGateway bool) bool {
+	window := cmd.ConfigData.DedupWindow
+	if window <= 0 {
+		return false
+	}
+	now := pkt.Received
+	if now.IsZero() {
+		now = time.Now()
+	}
+	key := packetKey(pkt, fromGateway)
+
+	recentPacketsLock.Lock()
+	defer recentPacketsLock.Unlock()
+	for k, t := range recentPackets {
+		if now.Sub(t) > window {
+			delete(recentPackets, k)
+		}
+	}
+	_, found := recentPackets[key]
+	recentPackets[key] = now
+	return found
+}
@@ -0,0 +1,55 @@
+package xpl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	old := cmd.ConfigData
+	t.Cleanup(func() {
+		cmd.ConfigData = old
+		recentPackets = map[string]time.Time{}
+	})
+	cmd.ConfigData.DedupWindow = time.Second
+	reading := Body{{"device", "th1 0x1234"}, {"type", "temp"}, {"current", "21"}}
+	hbeat := Body{{"interval", "5"}, {"version", "1.0"}}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		first     XPLPacket
+		second    XPLPacket
+		duplicate bool
+	}{
+		{
+			"reading from two gateways",
+			XPLPacket{Type: TypeTrig, Source: "rfxcom-lan.aaa", MessageType: "sensor.basic", Data: reading, Received: now},
+			XPLPacket{Type: TypeTrig, Source: "rfxcom-lan.bbb", MessageType: "sensor.basic", Data: reading, Received: now},
+			true,
+		},
+		{
+			"heartbeat from two gateways",
+			XPLPacket{Type: TypeStat, Source: "rfxcom-lan.aaa", MessageType: "hbeat.basic", Data: hbeat, Received: now},
+			XPLPacket{Type: TypeStat, Source: "rfxcom-lan.bbb", MessageType: "hbeat.basic", Data: hbeat, Received: now},
+			false,
+		},
+		{
+			"repeat after the window",
+			XPLPacket{Type: TypeTrig, Source: "rfxcom-lan.aaa", MessageType: "sensor.basic", Data: reading, Received: now},
+			XPLPacket{Type: TypeTrig, Source: "rfxcom-lan.aaa", MessageType: "sensor.basic", Data: reading, Received: now.Add(2 * time.Second)},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recentPackets = map[string]time.Time{}
+			isDuplicate(&tt.first, true)
+			if res := isDuplicate(&tt.second, true); res != tt.duplicate {
+				t.Errorf("got duplicate %v, want %v", res, tt.duplicate)
+			}
+		})
+	}
+}
@@ -1,21 +1,32 @@
 package xpl
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/droso-hass/xpl2mqtt/cmd"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-var encoders = map[string](func(Topic, string, *Server)){
+var ErrInvalidCommand = errors.New("invalid command")
+
+// encoders build the body of the xpl command matching a mqtt command
+var encoders = map[string](func(Topic, string) (Body, error)){
 	"x10.basic":     encodeX10,
 	"ac.basic":      encodeAC,
 	"x10.security":  encodeX10sec,
 	"control.basic": encodeControl,
 }
 
+// protocols supported by the RFXLAN for x10.basic commands
+var x10Protocols = []string{"x10", "arc", "flamingo", "koppla", "waveman", "harrison", "he105", "rts10"}
+
 var x10secStateToCmd = map[string]string{
 	"ARM_HOME": "arm-home",
 	"ARM_AWAY": "arm-away",
@@ -23,135 +34,276 @@ var x10secStateToCmd = map[string]string{
 	"TRIGGER":  "panic",
 }
 
-func sendXplPacket(srv *Server, msgType string, data map[string]string) {
+// xpl source of the bridge, in the vendor-device.instance format
+func XPLSource() string {
+	return currentConfig().source()
+}
+
+// done is called once every repeat of the packet has been sent, it can be nil
+func sendXplPacket(srv *Server, topic Topic, data Body, done func(int, error)) error {
+	prio, ok := schemaPriorities[topic.MessageType]
+	if !ok {
+		prio = PriorityNormal
+	}
+	return sendXplPacketPriority(srv, topic, data, prio, done)
+}
+
+func sendXplPacketPriority(srv *Server, topic Topic, data Body, prio Priority, done func(int, error)) error {
+	msgType := topic.MessageType
+	target, addr := commandDestination(topic)
 	p := XPLPacket{
 		Type:        TypeCmnd,
-		Hop:         cmd.ConfigData.XPLHops,
-		Source:      fmt.Sprintf("xpl2mqtt-%s", cmd.ConfigData.ClientID),
-		Target:      cmd.ConfigData.XPLTarget,
+		Hop:         currentConfig().Hops,
+		Source:      XPLSource(),
+		Target:      target,
 		MessageType: msgType,
 		Data:        data,
 	}
 	slog.Debug("sending xpl packet", "packet", p)
-	err := srv.Write(&p, cmd.ConfigData.BroadcastAddress, cmd.ConfigData.Retries)
-	if err != nil {
-		slog.Error("error sending xpl packet", "error", err.Error())
-	}
+	return srv.write(&p, deviceKey(topic.MessageType, topic.DeviceID), addr, currentConfig().Retries, prio, done)
 }
 
 func ProcessMqtt(client mqtt.Client, msg mqtt.Message, srv *Server) {
 	p := string(msg.Payload())
 	slog.Debug("received mqtt message", "topic", msg.Topic(), "message", p)
+	if msg.Topic() == RawCommandTopic() {
+		if cmd.ConfigData.Raw {
+			err := processRawCommand(p, srv)
+			if err != nil {
+				rejectCommand(srv.mqtt, msg.Topic(), p, err)
+			}
+		}
+		return
+	}
+	// the base topic also holds our own state topics, only commands and get requests are handled
+	if !isCommandTopic(msg.Topic()) {
+		return
+	}
 	t := Topic{}
 	err := t.Parse(msg.Topic())
 	if err != nil {
-		slog.Error("error parsing topic", "error", err)
+		rejectCommand(srv.mqtt, msg.Topic(), p, err)
 		return
 	}
-	if t.Action == "set" {
-		enc, _ := encoders[t.MessageType]
-		enc(t, p, srv)
-	}
-}
-
-func encodeX10(topic Topic, payload string, srv *Server) {
-	// value for brightness topic should be between 0 and 10
-	// possible protocols are: X10,arc,flamingo,koppla,waveman,harrison,he105,rts10
-	data := map[string]string{
-		"device":   topic.DeviceID,
-		"protocol": topic.DeviceType,
-	}
-	if topic.DeviceParam == "switch" && payload == "ON" {
-		data["command"] = "on"
-	} else if topic.DeviceParam == "switch" && payload == "OFF" {
-		data["command"] = "off"
-	} else if topic.DeviceParam == "all" && payload == "ON" {
-		data["command"] = "all_lights_on"
-	} else if topic.DeviceParam == "all" && payload == "OFF" {
-		data["command"] = "all_lights_off"
-	} else if topic.DeviceParam == "bright" && payload == "ON" {
-		data["command"] = "bright"
-	} else if topic.DeviceParam == "bright" && payload == "OFF" {
-		data["command"] = "dim"
-	} else if topic.DeviceParam == "brightness" {
-		data["command"] = "on"
-		val, err := strconv.Atoi(payload)
+	if t.Action == "get" {
+		err = republishState(srv.mqtt, t)
 		if err != nil {
-			return
+			rejectCommand(srv.mqtt, msg.Topic(), p, err)
 		}
-		data["level"] = strconv.Itoa(val * 10)
+		return
 	}
+	enc, ok := encoders[t.MessageType]
+	if !ok {
+		rejectCommand(srv.mqtt, msg.Topic(), p, commandError("unsupported schema %q", t.MessageType))
+		return
+	}
+	value, id, err := parseCommandPayload(p)
+	if err != nil {
+		rejectCommand(srv.mqtt, msg.Topic(), p, err)
+		return
+	}
+	data, err := enc(t, value)
+	var req *request
+	var done func(int, error)
+	if id != "" {
+		req = newRequest(srv.mqtt, id, msg.Topic(), t, data)
+		done = req.transmitted
+	}
+	if err == nil {
+		err = sendXplPacket(srv, t, data, done)
+	}
+	if err != nil {
+		rejectCommand(srv.mqtt, msg.Topic(), p, err)
+		req.finish(statusRejected, err)
+		return
+	}
+	rememberCommand(t, value)
+	if isOptimistic(t) {
+		publishOptimistic(srv.mqtt, t, value)
+	}
+}
 
-	sendXplPacket(srv, topic.MessageType, data)
+// mqtt command which could not be sent, published to the errors topic
+type CommandError struct {
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
 }
 
-func encodeAC(topic Topic, payload string, srv *Server) {
-	data := map[string]string{
-		"address": topic.DeviceID,
-		"unit":    topic.DeviceType,
+func BridgeErrorsTopic() string {
+	return fmt.Sprintf("%s/bridge/errors", cmd.ConfigData.MqttBaseTopic)
+}
+
+func commandError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCommand, fmt.Sprintf(format, args...))
+}
+
+func rejectCommand(c *mqtt.Client, topic string, payload string, err error) {
+	slog.Warn("mqtt command rejected", "topic", topic, "message", payload, "error", err.Error())
+	data, jerr := json.Marshal(CommandError{Topic: topic, Payload: payload, Error: err.Error(), Time: time.Now()})
+	if jerr != nil {
+		slog.Error("error encoding command error", "error", jerr.Error())
+		return
 	}
-	if topic.DeviceParam == "switch" && payload == "ON" {
-		data["command"] = "on"
-	} else if topic.DeviceParam == "switch" && payload == "OFF" {
-		data["command"] = "off"
-	} else if topic.DeviceParam == "brightness" {
-		data["command"] = "preset"
-		data["level"] = payload
+	sendMqttPacket(c, BridgeErrorsTopic(), string(data))
+}
+
+// ON or OFF payload
+func parseSwitch(payload string) (bool, error) {
+	switch payload {
+	case "ON":
+		return true, nil
+	case "OFF":
+		return false, nil
 	}
-	sendXplPacket(srv, topic.MessageType, data)
+	return false, commandError("expected ON or OFF, got %q", payload)
 }
 
-func encodeX10sec(topic Topic, payload string, srv *Server) {
-	data := map[string]string{
-		"device": topic.DeviceID,
+// integer payload between min and max
+func parseLevel(payload string, min int, max int) (int, error) {
+	val, err := strconv.Atoi(payload)
+	if err != nil || val < min || val > max {
+		return 0, commandError("expected an integer between %d and %d, got %q", min, max, payload)
 	}
+	return val, nil
+}
 
+func encodeX10(topic Topic, payload string) (Body, error) {
+	// value for brightness topic should be between 0 and 10
+	if !slices.Contains(x10Protocols, strings.ToLower(topic.DeviceType)) {
+		return nil, commandError("unsupported x10.basic protocol %q", topic.DeviceType)
+	}
+	data := Body{}
+	data.Add("device", topic.DeviceID)
+	data.Add("protocol", topic.DeviceType)
 	switch topic.DeviceParam {
-	case "alarm":
-		data["command"] = x10secStateToCmd[payload]
-
-	case "panic":
-		if payload == "ON" {
-			data["command"] = "panic"
-		} else {
-			data["command"] = "normal"
+	case "switch", "all", "bright":
+		on, err := parseSwitch(payload)
+		if err != nil {
+			return nil, err
 		}
-
-	case "motion":
-		if payload == "ON" {
-			data["command"] = "motion"
+		commands := map[string][2]string{
+			"switch": {"off", "on"},
+			"all":    {"all_lights_off", "all_lights_on"},
+			"bright": {"dim", "bright"},
+		}[topic.DeviceParam]
+		if on {
+			data.Set("command", commands[1])
 		} else {
-			data["command"] = "normal"
+			data.Set("command", commands[0])
 		}
-
 	case "brightness":
-		if payload == "ON" {
-			data["command"] = "light"
-		} else {
-			data["command"] = "dark"
+		val, err := parseLevel(payload, 0, 10)
+		if err != nil {
+			return nil, err
 		}
+		data.Set("command", "on")
+		data.Set("level", strconv.Itoa(val*10))
+	default:
+		return nil, commandError("unsupported x10.basic parameter %q", topic.DeviceParam)
+	}
+	return data, nil
+}
 
+func encodeAC(topic Topic, payload string) (Body, error) {
+	if !isHex(topic.DeviceID) {
+		return nil, commandError("ac.basic address %q is not an hexadecimal number", topic.DeviceID)
+	}
+	if topic.DeviceType != "group" {
+		if _, err := parseLevel(topic.DeviceType, 0, 16); err != nil {
+			return nil, commandError("ac.basic unit %q is not group or a number between 0 and 16", topic.DeviceType)
+		}
+	}
+	data := Body{}
+	data.Add("address", topic.DeviceID)
+	data.Add("unit", topic.DeviceType)
+	switch topic.DeviceParam {
 	case "switch":
-		if payload == "ON" {
-			data["command"] = "lights-on"
+		on, err := parseSwitch(payload)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			data.Set("command", "on")
 		} else {
-			data["command"] = "lights-off"
+			data.Set("command", "off")
+		}
+	case "brightness":
+		if _, err := parseLevel(payload, 0, 15); err != nil {
+			return nil, err
 		}
+		data.Set("command", "preset")
+		data.Set("level", payload)
+	default:
+		return nil, commandError("unsupported ac.basic parameter %q", topic.DeviceParam)
 	}
-	sendXplPacket(srv, topic.MessageType, data)
+	return data, nil
 }
 
-func encodeControl(topic Topic, payload string, srv *Server) {
-	data := map[string]string{
-		"device": topic.DeviceID,
-		"type":   topic.DeviceType,
-	}
-	if topic.DeviceType == "output" {
-		if payload == "ON" {
-			data["current"] = "high" // is it really current (and not command) ?
-		} else {
-			data["current"] = "low"
+func encodeX10sec(topic Topic, payload string) (Body, error) {
+	data := Body{}
+	data.Add("device", topic.DeviceID)
+
+	if topic.DeviceParam == "alarm" {
+		command, ok := x10secStateToCmd[payload]
+		if !ok {
+			return nil, commandError("unsupported alarm state %q", payload)
 		}
-		sendXplPacket(srv, topic.MessageType, data)
+		data.Set("command", command)
+		return data, nil
+	}
+
+	commands, ok := map[string][2]string{
+		"panic":      {"normal", "panic"},
+		"motion":     {"normal", "motion"},
+		"brightness": {"dark", "light"},
+		"switch":     {"lights-off", "lights-on"},
+	}[topic.DeviceParam]
+	if !ok {
+		return nil, commandError("unsupported x10.security parameter %q", topic.DeviceParam)
+	}
+	on, err := parseSwitch(payload)
+	if err != nil {
+		return nil, err
+	}
+	if on {
+		data.Set("command", commands[1])
+	} else {
+		data.Set("command", commands[0])
+	}
+	return data, nil
+}
+
+func encodeControl(topic Topic, payload string) (Body, error) {
+	// only the RFXLAN I/O lines are implemented
+	if topic.DeviceType != "output" {
+		return nil, commandError("unsupported control.basic type %q", topic.DeviceType)
+	}
+	if topic.DeviceParam != "switch" {
+		return nil, commandError("unsupported control.basic parameter %q", topic.DeviceParam)
+	}
+	on, err := parseSwitch(payload)
+	if err != nil {
+		return nil, err
+	}
+	data := Body{}
+	data.Add("device", topic.DeviceID)
+	data.Add("type", topic.DeviceType)
+	if on {
+		data.Set("current", "high") // is it really current (and not command) ?
+	} else {
+		data.Set("current", "low")
+	}
+	return data, nil
+}
+
+// 0x prefixed hexadecimal number
+func isHex(s string) bool {
+	h, found := strings.CutPrefix(strings.ToLower(s), "0x")
+	if !found || h == "" {
+		return false
 	}
+	_, err := strconv.ParseUint(h, 16, 32)
+	return err == nil
 }
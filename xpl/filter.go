@@ -0,0 +1,57 @@
+package xpl
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// checks that a filter is in the msgtype.vendor.device.instance.class.type format, * matches any value
+func validateFilter(filter string) error {
+	if len(strings.Split(filter, ".")) != 6 {
+		return errors.New("filter must be in the msgtype.vendor.device.instance.class.type format")
+	}
+	return nil
+}
+
+func validateGroup(group string) error {
+	if err := validateTarget(group); err != nil || !strings.HasPrefix(group, groupPrefix) {
+		return errors.New("group must be in the xpl-group.name format")
+	}
+	return nil
+}
+
+func matchFilter(filter string, pkt *XPLPacket) bool {
+	vd, instance, _ := strings.Cut(pkt.Source, ".")
+	vendor, device, _ := strings.Cut(vd, "-")
+	class, tp, _ := strings.Cut(pkt.MessageType, ".")
+	values := []string{string(pkt.Type), vendor, device, instance, class, tp}
+
+	parts := strings.Split(filter, ".")
+	if len(parts) != len(values) {
+		return false
+	}
+	for i, p := range parts {
+		if p != "*" && p != values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the packet is addressed to the bridge (directly, to one of its groups or to everyone) and matches its filters
+func Accepts(pkt *XPLPacket) bool {
+	c := currentConfig()
+	if pkt.Target != "*" && pkt.Target != c.source() && !slices.Contains(c.Groups, pkt.Target) {
+		return false
+	}
+	if len(c.Filters) == 0 {
+		return true
+	}
+	for _, f := range c.Filters {
+		if matchFilter(f, pkt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package xpl
+
+import (
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// gateway the commands can be sent through, configured or discovered from the received packets
+type gateway struct {
+	name     string
+	source   string // empty until a packet of a configured gateway is received
+	addr     *net.UDPAddr
+	received int // packets received from the gateway
+}
+
+// receptions of a device by a gateway
+type reception struct {
+	LastSeen time.Time `json:"last_seen"`
+	Count    int       `json:"count"`
+}
+
+// gateways by name
+var gateways = map[string]*gateway{}
+
+// receptions of each device, by deviceKey and gateway name
+var deviceGateways = map[string]map[string]*reception{}
+var gatewaysLock sync.Mutex
+
+func initGateways() {
+	gatewaysLock.Lock()
+	defer gatewaysLock.Unlock()
+	for _, g := range cmd.ConfigData.Gateways {
+		gateways[g.Name] = &gateway{name: g.Name, source: g.Source, addr: g.Addr}
+	}
+}
+
+func (g *gateway) target() string {
+	if g.source == "" {
+		return "*"
+	}
+	return g.source
+}
+
+// whether the xpl source is a RF gateway (ex: a RFXLAN) the commands can be sent to
+func isGateway(source string) bool {
+	match, err := path.Match(cmd.ConfigData.GatewaySource, source)
+	return err == nil && match
+}
+
+func deviceKey(schema string, id string) string {
+	return schema + "/" + id
+}
+
+// identifier of the device a packet is about, as used in the topics
+func packetDeviceID(pkt *XPLPacket) string {
+	switch pkt.MessageType {
+	case "ac.basic":
+		return pkt.Data.Get("address")
+	case "sensor.basic":
+		// the device is in the "type id" format
+		s := strings.Split(pkt.Data.Get("device"), " ")
+		return s[len(s)-1]
+	default:
+		return pkt.Data.Get("device")
+	}
+}
+
+// gateway which sent the packet, nil if it was not sent by a gateway
+func gatewayOf(pkt *XPLPacket) *gateway {
+	for _, g := range gateways {
+		if g.source == pkt.Source {
+			return g
+		}
+	}
+	if pkt.RemoteAddr == nil {
+		return nil
+	}
+	for _, g := range gateways {
+		if g.source == "" && g.addr.IP.Equal(pkt.RemoteAddr.IP) {
+			g.source = pkt.Source
+			slog.Info("xpl gateway source learned", "gateway", g.name, "source", g.source)
+			return g
+		}
+	}
+	if cmd.ConfigData.GatewayDiscovery && isGateway(pkt.Source) {
+		g := &gateway{
+			name:   pkt.Source,
+			source: pkt.Source,
+			addr:   &net.UDPAddr{IP: pkt.RemoteAddr.IP, Port: XPLPort},
+		}
+		gateways[g.name] = g
+		return g
+	}
+	return nil
+}
+
+// records which gateway heard the device of the packet, returns false if it was not sent by a gateway
+func recordGateway(pkt *XPLPacket) bool {
+	gatewaysLock.Lock()
+	defer gatewaysLock.Unlock()
+	g := gatewayOf(pkt)
+	if g == nil {
+		return false
+	}
+	g.received++
+	id := packetDeviceID(pkt)
+	if id == "" {
+		return true
+	}
+	key := deviceKey(pkt.MessageType, id)
+	if _, ok := deviceGateways[key]; !ok {
+		deviceGateways[key] = map[string]*reception{}
+	}
+	r, ok := deviceGateways[key][g.name]
+	if !ok {
+		r = &reception{}
+		deviceGateways[key][g.name] = r
+		slog.Info("device heard by a new gateway", "device", key, "gateway", g.name)
+	}
+	r.LastSeen = time.Now()
+	r.Count++
+	coverageChanged[key] = true
+	return true
+}
+
+// gateway which most recently heard the device, skipping the offline ones
+func learnedGateway(key string) *gateway {
+	var res *gateway
+	var last time.Time
+	for name, r := range deviceGateways[key] {
+		g, ok := gateways[name]
+		if ok && r.LastSeen.After(last) && !isOfflineDevice(g.source) {
+			res = g
+			last = r.LastSeen
+		}
+	}
+	return res
+}
+
+// online gateway learned from the heartbeats, false unless it is the only one
+func discoveredGateway() (string, *net.UDPAddr, bool) {
+	devicesLock.Lock()
+	defer devicesLock.Unlock()
+	var gw *XPLDevice
+	for _, dev := range devices {
+		if dev.Online && dev.IP != "" && isGateway(dev.Source) {
+			if gw != nil {
+				return "", nil, false
+			}
+			gw = dev
+		}
+	}
+	if gw == nil {
+		return "", nil, false
+	}
+	ip := net.ParseIP(gw.IP)
+	if ip == nil {
+		return "", nil, false
+	}
+	port := gw.Port
+	if port == 0 {
+		port = XPLPort
+	}
+	return gw.Source, &net.UDPAddr{IP: ip, Port: port}, true
+}
+
+// xpl target and address of a command, in order:
+//   - the gateway of the first routing rule matching the topic
+//   - the gateway which most recently heard the device
+//   - the gateway learned from the heartbeats, when no other gateway is known
+//   - the configured target and broadcast address, which reaches every gateway
+func commandDestination(topic Topic) (string, *net.UDPAddr) {
+	gatewaysLock.Lock()
+	name := path.Join(topic.MessageType, topic.DeviceType, topic.DeviceID)
+	for _, r := range cmd.ConfigData.Routes {
+		if match, _ := path.Match(r.Pattern, name); match {
+			g := gateways[r.Gateway]
+			gatewaysLock.Unlock()
+			return g.target(), g.addr
+		}
+	}
+	if g := learnedGateway(deviceKey(topic.MessageType, topic.DeviceID)); g != nil {
+		gatewaysLock.Unlock()
+		return g.target(), g.addr
+	}
+	// addresses of the configured gateways and of the ones discovered from their messages
+	known := map[string]bool{}
+	for _, g := range gateways {
+		known[g.addr.IP.String()] = true
+	}
+	gatewaysLock.Unlock()
+
+	if cmd.ConfigData.GatewayDiscovery {
+		// a device never heard is sent to every gateway when there are several of them
+		if source, addr, ok := discoveredGateway(); ok {
+			delete(known, addr.IP.String())
+			if len(known) == 0 {
+				return source, addr
+			}
+		}
+	}
+	return cmd.ConfigData.XPLTarget, cmd.ConfigData.BroadcastAddress
+}
@@ -0,0 +1,49 @@
+package xpl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+func TestCommandDestination(t *testing.T) {
+	old := cmd.ConfigData
+	t.Cleanup(func() {
+		cmd.ConfigData = old
+		devices = map[string]*XPLDevice{}
+		gateways = map[string]*gateway{}
+		deviceGateways = map[string]map[string]*reception{}
+	})
+	cmd.ConfigData.GatewayDiscovery = true
+	cmd.ConfigData.GatewaySource = "rfxcom-lan.*"
+	cmd.ConfigData.XPLTarget = "*"
+	cmd.ConfigData.BroadcastAddress = &net.UDPAddr{IP: net.IPv4bcast, Port: XPLPort}
+	aaa := &XPLDevice{Source: "rfxcom-lan.aaa", IP: "192.168.1.20", Online: true, LastSeen: time.Now().Add(-time.Minute)}
+	bbb := &XPLDevice{Source: "rfxcom-lan.bbb", IP: "192.168.1.21", Online: true, LastSeen: time.Now()}
+	topic := Topic{MessageType: "ac.basic", DeviceType: "ac", DeviceID: "0x123456-1", DeviceParam: "switch", Action: "set"}
+
+	tests := []struct {
+		name    string
+		devices []*XPLDevice
+		target  string
+		ip      net.IP
+	}{
+		{"no gateway", nil, "*", net.IPv4bcast},
+		{"one gateway", []*XPLDevice{aaa}, "rfxcom-lan.aaa", net.ParseIP("192.168.1.20")},
+		{"several gateways", []*XPLDevice{aaa, bbb}, "*", net.IPv4bcast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices = map[string]*XPLDevice{}
+			for _, d := range tt.devices {
+				devices[d.Source] = d
+			}
+			target, addr := commandDestination(topic)
+			if target != tt.target || !addr.IP.Equal(tt.ip) {
+				t.Errorf("got %s at %s, want %s at %s", target, addr, tt.target, tt.ip)
+			}
+		})
+	}
+}
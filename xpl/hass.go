@@ -12,21 +12,33 @@ import (
 var HADiscovery = make(map[string][]string)
 
 type HAConfig struct {
-	Name                   string   `json:"name,omitempty"`
-	UniqueID               string   `json:"unique_id,omitempty"`
-	DeviceClass            string   `json:"device_class,omitempty"`
-	StateTopic             string   `json:"state_topic,omitempty"`
-	Unit                   string   `json:"unit_of_measurement,omitempty"`
-	CommandTopic           string   `json:"command_topic,omitempty"`
-	BrightnessScale        int      `json:"brightness_scale,omitempty"`
-	BrightnessStateTopic   string   `json:"brightness_state_topic,omitempty"`
-	BrightnessCommandTopic string   `json:"brightness_command_topic,omitempty"`
-	Icon                   string   `json:"icon,omitempty"`
-	Device                 HADevice `json:"device,omitempty"`
-	SupportedFeatures      []string `json:"supported_features,omitempty"`
-	CodeArmRequired        bool     `json:"code_arm_required,omitempty"`
-	CodeDisarmRequired     bool     `json:"code_disarm_required,omitempty"`
-	CodeTriggerRequired    bool     `json:"code_trigger_required,omitempty"`
+	Name                    string           `json:"name,omitempty"`
+	UniqueID                string           `json:"unique_id,omitempty"`
+	DeviceClass             string           `json:"device_class,omitempty"`
+	StateTopic              string           `json:"state_topic,omitempty"`
+	ValueTemplate           string           `json:"value_template,omitempty"`
+	Unit                    string           `json:"unit_of_measurement,omitempty"`
+	CommandTopic            string           `json:"command_topic,omitempty"`
+	Optimistic              bool             `json:"optimistic,omitempty"`
+	BrightnessScale         int              `json:"brightness_scale,omitempty"`
+	BrightnessStateTopic    string           `json:"brightness_state_topic,omitempty"`
+	BrightnessValueTemplate string           `json:"brightness_value_template,omitempty"`
+	BrightnessCommandTopic  string           `json:"brightness_command_topic,omitempty"`
+	Icon                    string           `json:"icon,omitempty"`
+	Device                  HADevice         `json:"device,omitempty"`
+	SupportedFeatures       []string         `json:"supported_features,omitempty"`
+	CodeArmRequired         bool             `json:"code_arm_required,omitempty"`
+	CodeDisarmRequired      bool             `json:"code_disarm_required,omitempty"`
+	CodeTriggerRequired     bool             `json:"code_trigger_required,omitempty"`
+	Availability            []HAAvailability `json:"availability,omitempty"`
+	AvailabilityMode        string           `json:"availability_mode,omitempty"`
+	JsonAttributesTopic     string           `json:"json_attributes_topic,omitempty"`
+}
+
+type HAAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
 }
 
 type HADevice struct {
@@ -36,11 +48,35 @@ type HADevice struct {
 	Model        string   `json:"model"`
 }
 
-func sendHassPacket(client *mqtt.Client, deviceType string, deviceId string, data HAConfig) {
+func sendHassPacket(client *mqtt.Client, pkt *XPLPacket, deviceType string, deviceId string, data HAConfig) {
 	if !cmd.ConfigData.HassDiscovery {
 		return
 	}
 	data.Device.Manifacturer = "xpl2mqtt"
+	// the state published by the bridge after a command is an assumed one
+	if data.CommandTopic != "" {
+		t := Topic{}
+		data.Optimistic = t.Parse(data.CommandTopic) == nil && isOptimistic(t)
+	}
+	if cmd.ConfigData.JsonState {
+		jsonStateConfig(&data)
+	}
+	// the entity is unavailable when the bridge is offline, or when the only xpl device which receives it stops sending heartbeats
+	// a device heard by several gateways stays available as long as the bridge is online
+	data.Availability = append(data.Availability, HAAvailability{Topic: BridgeStateTopic()})
+	key := deviceKey(pkt.MessageType, packetDeviceID(pkt))
+	receivers := deviceReceivers(key)
+	if len(receivers) == 0 {
+		receivers = []string{pkt.Source}
+	}
+	if len(receivers) == 1 && isKnownDevice(receivers[0]) {
+		data.Availability = append(data.Availability, HAAvailability{Topic: DeviceAvailabilityTopic(receivers[0])})
+		data.AvailabilityMode = "all"
+	}
+	// the gateways which heard the device are shown as attributes of the entity
+	if hasCoverage(key) {
+		data.JsonAttributesTopic = CoverageTopic(key)
+	}
 	sdata, err := json.Marshal(data)
 	if err != nil {
 		return
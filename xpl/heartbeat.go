@@ -0,0 +1,116 @@
+package xpl
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// heartbeat rate while waiting for the hub, as defined in the xpl specification
+const (
+	hubDiscoveryInterval     = 3 * time.Second
+	hubDiscoverySlowInterval = 30 * time.Second
+	hubDiscoveryTimeout      = 2 * time.Minute
+	// a hbeat.request is answered after a random delay in this range to avoid flooding the network
+	hbeatRequestMinDelay = 2 * time.Second
+	hbeatRequestMaxDelay = 6 * time.Second
+)
+
+var broadcastAddr = &net.UDPAddr{IP: net.IPv4bcast, Port: XPLPort}
+
+// hbeat.app, or config.app while the bridge waits for its configuration
+func (p *Server) heartbeatPacket() XPLPacket {
+	data := Body{}
+	data.Add("interval", strconv.Itoa(currentConfig().Interval))
+	data.Add("port", strconv.Itoa(p.port()))
+	data.Add("remote-ip", p.localIP().String())
+	schema := "hbeat.app"
+	if !p.configured.Load() {
+		schema = "config.app"
+	}
+	return XPLPacket{
+		Type:        TypeStat,
+		Hop:         1,
+		Source:      XPLSource(),
+		Target:      "*",
+		MessageType: schema,
+		Data:        data,
+	}
+}
+
+func (p *Server) sendHeartbeat() {
+	pkt := p.heartbeatPacket()
+	slog.Debug("sending xpl heartbeat", "packet", pkt)
+	err := p.WritePriority(&pkt, broadcastAddr, 1, PriorityLow)
+	if err != nil {
+		slog.Error("error sending xpl heartbeat", "error", err.Error())
+	}
+}
+
+// hbeat.end (or config.end) tells the hub and the other applications that the bridge is leaving
+func (p *Server) sendHeartbeatEnd() {
+	pkt := p.heartbeatPacket()
+	if pkt.MessageType == "config.app" {
+		pkt.MessageType = "config.end"
+	} else {
+		pkt.MessageType = "hbeat.end"
+	}
+	slog.Debug("sending xpl heartbeat end", "packet", pkt)
+	err := p.WritePriority(&pkt, broadcastAddr, 1, PriorityLow)
+	if err != nil {
+		slog.Error("error sending xpl heartbeat", "error", err.Error())
+	}
+}
+
+// sends heartbeats quickly until the hub relays one of them, then at the configured interval
+func (p *Server) runHeartbeat(ctx context.Context) {
+	start := time.Now()
+	for {
+		p.sendHeartbeat()
+		delay := time.Duration(currentConfig().Interval) * time.Minute
+		if p.mode == "client" && !p.hubFound.Load() {
+			delay = hubDiscoveryInterval
+			if time.Since(start) > hubDiscoveryTimeout {
+				delay = hubDiscoverySlowInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (p *Server) processHeartbeat(pkt *XPLPacket) {
+	switch pkt.MessageType {
+	case "hbeat.app", "config.app":
+		if p.mode == "client" && pkt.Source == XPLSource() && !p.hubFound.Load() {
+			p.hubFound.Store(true)
+			slog.Info("connected to the xpl hub", "port", p.port())
+		}
+	case "hbeat.request":
+		if pkt.Type != TypeCmnd || !Accepts(pkt) {
+			return
+		}
+		// only one answer is sent for the requests received during the delay
+		if !p.hbeatRequested.CompareAndSwap(false, true) {
+			return
+		}
+		delay := hbeatRequestMinDelay + time.Duration(rand.Int63n(int64(hbeatRequestMaxDelay-hbeatRequestMinDelay)))
+		slog.Debug("xpl heartbeat requested", "source", pkt.Source, "delay", delay)
+		go func() {
+			// no heartbeat is sent after the hbeat.end of the shutdown
+			select {
+			case <-p.stopping:
+				return
+			case <-time.After(delay):
+			}
+			p.hbeatRequested.Store(false)
+			p.sendHeartbeat()
+		}()
+	}
+}
@@ -0,0 +1,102 @@
+package xpl
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type hubClient struct {
+	addr     *net.UDPAddr
+	interval time.Duration
+	lastSeen time.Time
+}
+
+// relays the xpl packets received on the xpl port to the local applications listening on other ports
+type hub struct {
+	lock    sync.Mutex
+	clients map[string]*hubClient
+}
+
+func newHub() *hub {
+	return &hub{
+		clients: map[string]*hubClient{},
+	}
+}
+
+// registers, refreshes or removes a local application from its heartbeats
+func (h *hub) process(pkt *XPLPacket) {
+	if pkt.MessageType != "hbeat.app" && pkt.MessageType != "config.app" && pkt.MessageType != "hbeat.end" && pkt.MessageType != "config.end" {
+		return
+	}
+	port, err := strconv.Atoi(pkt.Data.Get("port"))
+	// the xpl port belongs to the hub, which also receives its own heartbeats
+	if err != nil || port <= 0 || port > 65535 || port == XPLPort {
+		return
+	}
+	ip := net.ParseIP(pkt.Data.Get("remote-ip"))
+	if ip == nil || !isLocalIP(ip) {
+		return
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if pkt.MessageType == "hbeat.end" || pkt.MessageType == "config.end" {
+		if _, ok := h.clients[addr.String()]; ok {
+			slog.Info("xpl hub client removed", "source", pkt.Source, "address", addr.String())
+			delete(h.clients, addr.String())
+		}
+		return
+	}
+
+	interval, err := strconv.Atoi(pkt.Data.Get("interval"))
+	if err != nil || interval <= 0 {
+		interval = 5
+	}
+	client, ok := h.clients[addr.String()]
+	if !ok {
+		slog.Info("xpl hub client added", "source", pkt.Source, "address", addr.String())
+		client = &hubClient{addr: addr}
+		h.clients[addr.String()] = client
+	}
+	client.interval = time.Duration(interval) * time.Minute
+	client.lastSeen = time.Now()
+}
+
+// sends a received packet to every local application, the ones which missed their heartbeats are removed
+func (h *hub) forward(conn *net.UDPConn, data []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	for k, client := range h.clients {
+		// as in the xpl specification, a client is removed after (2 * interval) + 1 minute without heartbeat
+		if now.Sub(client.lastSeen) > 2*client.interval+time.Minute {
+			slog.Info("xpl hub client expired", "address", k)
+			delete(h.clients, k)
+			continue
+		}
+		_, err := conn.WriteToUDP(data, client.addr)
+		if err != nil {
+			slog.Debug("error forwarding xpl packet", "address", k, "error", err.Error())
+		}
+	}
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
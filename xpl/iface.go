@@ -0,0 +1,211 @@
+package xpl
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// network interface used for the xpl traffic
+type xplInterface struct {
+	iface *net.Interface
+	// ipv4 networks of the interface and their broadcast addresses
+	nets       []*net.IPNet
+	broadcasts []net.IP
+}
+
+// ipv6 multicast socket, iface is nil when no interface is configured
+type multicastListener struct {
+	conn  *net.UDPConn
+	iface *xplInterface
+}
+
+type received struct {
+	data  []byte
+	addr  *net.UDPAddr
+	iface *xplInterface
+}
+
+func loadInterfaces(names []string) ([]*xplInterface, error) {
+	res := []*xplInterface{}
+	for _, name := range names {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", name, err)
+		}
+		if ifi.Flags&net.FlagUp == 0 {
+			slog.Warn("network interface is down", "interface", name)
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", name, err)
+		}
+		i := &xplInterface{iface: ifi}
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok || n.IP.To4() == nil {
+				continue
+			}
+			i.nets = append(i.nets, n)
+			i.broadcasts = append(i.broadcasts, broadcastIP(n))
+		}
+		if len(i.nets) == 0 && !cmd.ConfigData.XPLIPv6 {
+			return nil, fmt.Errorf("interface %s has no ipv4 address", name)
+		}
+		slog.Info("listening on interface", "interface", name, "broadcast", i.broadcasts)
+		res = append(res, i)
+	}
+	return res, nil
+}
+
+func broadcastIP(n *net.IPNet) net.IP {
+	ip := n.IP.To4()
+	mask := n.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	res := make(net.IP, net.IPv4len)
+	for i := range res {
+		res[i] = ip[i] | ^mask[i]
+	}
+	return res
+}
+
+func (i *xplInterface) name() string {
+	if i == nil {
+		return ""
+	}
+	return i.iface.Name
+}
+
+func (i *xplInterface) contains(ip net.IP) bool {
+	for _, n := range i.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// joins the xpl multicast group on every interface, or on the default one
+func listenMulticast(group net.IP, port int, ifaces []*xplInterface) ([]*multicastListener, error) {
+	if group == nil || !group.IsMulticast() || group.To4() != nil {
+		return nil, errors.New("invalid ipv6 multicast group")
+	}
+	addr := &net.UDPAddr{IP: group, Port: port}
+	if len(ifaces) == 0 {
+		conn, err := net.ListenMulticastUDP("udp6", nil, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*multicastListener{{conn: conn}}, nil
+	}
+	res := []*multicastListener{}
+	for _, i := range ifaces {
+		conn, err := net.ListenMulticastUDP("udp6", i.iface, addr)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", i.name(), err)
+		}
+		res = append(res, &multicastListener{conn: conn, iface: i})
+	}
+	return res, nil
+}
+
+// interface of a received ipv4 packet, found from its source address
+func (p *Server) interfaceOf(ip net.IP) *xplInterface {
+	for _, i := range p.interfaces {
+		if i.contains(ip) {
+			return i
+		}
+	}
+	return nil
+}
+
+// records the interface of the xpl source of the packet, and of the device it is about
+func (p *Server) setHeardOn(pkt *XPLPacket, iface *xplInterface) {
+	if iface == nil {
+		return
+	}
+	p.heardLock.Lock()
+	defer p.heardLock.Unlock()
+	p.heard[pkt.Source] = iface
+	if id := packetDeviceID(pkt); id != "" {
+		p.heard[deviceKey(pkt.MessageType, id)] = iface
+	}
+}
+
+// interface where the xpl source or the device (by deviceKey) was last heard
+func (p *Server) heardOn(source string) *xplInterface {
+	p.heardLock.Lock()
+	defer p.heardLock.Unlock()
+	return p.heard[source]
+}
+
+// addresses where a packet sent to addr must go: a broadcast is sent on every interface, or only
+// on the one where the device (or else the target) was last heard, and to the multicast group
+func (p *Server) destinations(target string, device string, addr *net.UDPAddr) []*net.UDPAddr {
+	if !addr.IP.Equal(net.IPv4bcast) {
+		return []*net.UDPAddr{addr}
+	}
+	ifaces := p.interfaces
+	if i := p.heardOn(device); i != nil {
+		ifaces = []*xplInterface{i}
+	} else if i := p.heardOn(target); i != nil {
+		ifaces = []*xplInterface{i}
+	}
+
+	res := []*net.UDPAddr{}
+	if len(p.interfaces) == 0 {
+		res = append(res, addr)
+	}
+	for _, i := range ifaces {
+		for _, b := range i.broadcasts {
+			res = append(res, &net.UDPAddr{IP: b, Port: addr.Port})
+		}
+	}
+	if p.group != nil {
+		if len(p.interfaces) == 0 {
+			res = append(res, &net.UDPAddr{IP: p.group, Port: addr.Port})
+		}
+		for _, i := range ifaces {
+			res = append(res, &net.UDPAddr{IP: p.group, Port: addr.Port, Zone: i.name()})
+		}
+	}
+	return res
+}
+
+// sends data with the socket matching the address family and interface
+func (p *Server) send(data []byte, addr *net.UDPAddr) error {
+	if addr.IP.To4() != nil {
+		_, err := p.conn.WriteToUDP(data, addr)
+		return err
+	}
+	for _, l := range p.multicast {
+		if l.iface == nil || l.iface.name() == addr.Zone {
+			_, err := l.conn.WriteToUDP(data, addr)
+			return err
+		}
+	}
+	return fmt.Errorf("no socket to send to %s", addr.String())
+}
+
+// first ipv4 address of the configured interfaces, or of the host, which is not a loopback
+func (p *Server) localIP() net.IP {
+	for _, i := range p.interfaces {
+		if len(i.nets) > 0 {
+			return i.nets[0].IP.To4()
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+				return n.IP.To4()
+			}
+		}
+	}
+	return net.IPv4(127, 0, 0, 1).To4()
+}
@@ -0,0 +1,44 @@
+package xpl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDestinations(t *testing.T) {
+	lan := &xplInterface{iface: &net.Interface{Name: "eth0"}, broadcasts: []net.IP{net.ParseIP("192.168.1.255").To4()}}
+	iot := &xplInterface{iface: &net.Interface{Name: "eth1"}, broadcasts: []net.IP{net.ParseIP("10.0.0.255").To4()}}
+	p := &Server{interfaces: []*xplInterface{lan, iot}, heard: map[string]*xplInterface{}}
+	p.setHeardOn(&XPLPacket{Source: "rfxcom-lan.aaa", MessageType: "ac.basic", Data: Body{{"address", "0x123456"}}}, iot)
+	p.setHeardOn(&XPLPacket{Source: "acme-app.x", MessageType: "hbeat.app"}, lan)
+	bcast := &net.UDPAddr{IP: net.IPv4bcast, Port: XPLPort}
+
+	tests := []struct {
+		name   string
+		target string
+		device string
+		addr   *net.UDPAddr
+		want   []string
+	}{
+		{"unicast", "*", "", &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: XPLPort}, []string{"192.168.1.20:3865"}},
+		{"unknown device", "*", "ac.basic/0x999999", bcast, []string{"192.168.1.255:3865", "10.0.0.255:3865"}},
+		{"heard device", "*", "ac.basic/0x123456", bcast, []string{"10.0.0.255:3865"}},
+		{"heard target", "acme-app.x", "", bcast, []string{"192.168.1.255:3865"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := []string{}
+			for _, a := range p.destinations(tt.target, tt.device, tt.addr) {
+				res = append(res, a.String())
+			}
+			if len(res) != len(tt.want) {
+				t.Fatalf("got %v, want %v", res, tt.want)
+			}
+			for i := range res {
+				if res[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", res, tt.want)
+				}
+			}
+		})
+	}
+}
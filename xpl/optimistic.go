@@ -0,0 +1,53 @@
+package xpl
+
+import (
+	"path"
+	"slices"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// whether the state of the device is published as soon as a command is sent to it
+func isOptimistic(topic Topic) bool {
+	if !slices.Contains(cmd.ConfigData.OptimisticSchemas, topic.MessageType) {
+		return false
+	}
+	name := path.Join(topic.MessageType, topic.DeviceType, topic.DeviceID)
+	for _, pattern := range cmd.ConfigData.OptimisticExclude {
+		if match, _ := path.Match(pattern, name); match {
+			return false
+		}
+	}
+	return true
+}
+
+// states of the device parameters after a command, as published by the decoders
+func optimisticStates(topic Topic, payload string) Body {
+	states := Body{}
+	switch {
+	case topic.MessageType == "x10.security" && topic.DeviceParam == "alarm":
+		states.Add("alarm", x10secCmdToState[x10secStateToCmd[payload]])
+	case topic.MessageType == "ac.basic" && topic.DeviceParam == "brightness":
+		if payload == "0" {
+			states.Add("switch", "OFF")
+		} else {
+			states.Add("switch", "ON")
+		}
+		states.Add("brightness", payload)
+	default:
+		states.Add(topic.DeviceParam, payload)
+	}
+	return states
+}
+
+// publishes the states of a command which was queued, for devices which do not report back
+func publishOptimistic(c *mqtt.Client, topic Topic, payload string) {
+	for _, kv := range optimisticStates(topic, payload) {
+		t := topic
+		t.DeviceParam = kv.Key
+		t.Action = "state"
+		publishState(c, nil, t, kv.Value)
+	}
+	flushStates(c)
+}
@@ -3,14 +3,57 @@ package xpl
 import (
 	"errors"
 	"fmt"
-	"log/slog"
+	"net"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var ErrInvalidPacket = errors.New("invalid xpl packet")
 
+// rules of the xpl specification checked when decoding and encoding packets
+type PacketRule string
+
+const (
+	RuleStructure   PacketRule = "invalid message structure"
+	RuleMessageType PacketRule = "invalid message type"
+	RuleHeader      PacketRule = "invalid header"
+	RuleHop         PacketRule = "invalid hop count"
+	RuleSource      PacketRule = "invalid source"
+	RuleTarget      PacketRule = "invalid target"
+	RuleSchema      PacketRule = "invalid schema"
+	RuleKeyValue    PacketRule = "invalid name=value pair"
+	RuleKey         PacketRule = "invalid body key"
+	RuleValue       PacketRule = "invalid body value"
+)
+
+// PacketError is returned when a packet does not follow the xpl specification
+type PacketError struct {
+	Rule   PacketRule
+	Line   int // line of the packet that broke the rule, 0 when unknown
+	Detail string
+}
+
+func (e *PacketError) Error() string {
+	msg := fmt.Sprintf("%s: %s", ErrInvalidPacket.Error(), e.Rule)
+	if e.Line > 0 {
+		msg += fmt.Sprintf(" (line %d)", e.Line)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *PacketError) Unwrap() error {
+	return ErrInvalidPacket
+}
+
+func packetError(rule PacketRule, line int, format string, args ...any) *PacketError {
+	return &PacketError{Rule: rule, Line: line, Detail: fmt.Sprintf(format, args...)}
+}
+
 type XPLType string
 
 const (
@@ -21,17 +64,39 @@ const (
 
 var XPLTypes = []XPLType{TypeCmnd, TypeStat, TypeTrig}
 
+const (
+	maxHop         = 9
+	maxVendorLen   = 8
+	maxDeviceLen   = 8
+	maxInstanceLen = 16
+	maxClassLen    = 8
+	maxTypeLen     = 8
+	maxKeyLen      = 16
+	maxValueLen    = 128
+	groupPrefix    = "xpl-group."
+)
+
 type XPLPacket struct {
 	Type        XPLType
 	Hop         int
 	Source      string
 	Target      string
 	MessageType string
-	Data        map[string]string
+	Data        Body
+	// only set for received packets
+	Received   time.Time
+	RemoteAddr *net.UDPAddr
+	Interface  string // empty when no interface is configured
 }
 
-func EncodePacket(pkt XPLPacket) string {
-	data := fmt.Sprintf(
+func EncodePacket(pkt XPLPacket) (string, error) {
+	err := ValidatePacket(pkt)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(
+		&sb,
 		"%s\n{\nhop=%d\nsource=%s\ntarget=%s\n}\n%s\n{\n",
 		pkt.Type,
 		pkt.Hop,
@@ -39,93 +104,223 @@ func EncodePacket(pkt XPLPacket) string {
 		pkt.Target,
 		pkt.MessageType,
 	)
-	content := ""
-	for k, v := range pkt.Data {
-		content += fmt.Sprintf("%s=%s\n", k, v)
+	for _, kv := range pkt.Data {
+		fmt.Fprintf(&sb, "%s=%s\n", kv.Key, kv.Value)
 	}
-	data += content + "}"
-	return data
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+// checks that every field of the packet follows the xpl specification
+func ValidatePacket(pkt XPLPacket) error {
+	if !slices.Contains(XPLTypes, pkt.Type) {
+		return packetError(RuleMessageType, 0, "%q", pkt.Type)
+	}
+	if pkt.Hop < 1 || pkt.Hop > maxHop {
+		return packetError(RuleHop, 0, "%d is not between 1 and %d", pkt.Hop, maxHop)
+	}
+	if err := validateSource(pkt.Source); err != nil {
+		return packetError(RuleSource, 0, "%q: %s", pkt.Source, err.Error())
+	}
+	if err := validateTarget(pkt.Target); err != nil {
+		return packetError(RuleTarget, 0, "%q: %s", pkt.Target, err.Error())
+	}
+	if err := validateSchema(pkt.MessageType); err != nil {
+		return packetError(RuleSchema, 0, "%q: %s", pkt.MessageType, err.Error())
+	}
+	for _, kv := range pkt.Data {
+		if err := validateKey(kv.Key); err != nil {
+			return packetError(RuleKey, 0, "%q: %s", kv.Key, err.Error())
+		}
+		if err := validateValue(kv.Value); err != nil {
+			return packetError(RuleValue, 0, "%s: %s", kv.Key, err.Error())
+		}
+	}
+	return nil
 }
 
 func DecodePacket(data string) (XPLPacket, error) {
-	split := strings.Split(data, "\n")
-	if len(split) < 9 {
-		slog.Warn("invalid xpl packet: too short")
-		return XPLPacket{}, ErrInvalidPacket
-	}
-
-	pkt := XPLPacket{
-		Type: XPLType(split[0]),
-	}
-
-	var xplHeader map[string]string
-	xplData := map[string]string{}
-	isOpen := false
-	cpt := 0
-	for _, x := range split {
-		if x == "" {
-		} else if x == "{" {
-			xplData = map[string]string{}
-			isOpen = true
-		} else if x == "}" {
-			isOpen = false
-			if cpt == 0 {
-				xplHeader = xplData
-			} else if cpt == 1 {
-				pkt.Data = xplData
-			} else {
-				slog.Warn("invalid xpl packet: too much data")
-				return XPLPacket{}, ErrInvalidPacket
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	pkt := XPLPacket{}
+
+	// the packet is made of two blocks: the type and its header, and the schema and its body
+	header := Body{}
+	i := 0
+	for block := 0; block < 2; block++ {
+		for i < len(lines) && lines[i] == "" {
+			i++
+		}
+		if i+1 >= len(lines) {
+			return XPLPacket{}, packetError(RuleStructure, i+1, "packet too short")
+		}
+		name := strings.ToLower(lines[i])
+		if lines[i+1] != "{" {
+			return XPLPacket{}, packetError(RuleStructure, i+2, "expected '{'")
+		}
+		if block == 0 {
+			pkt.Type = XPLType(name)
+			if !slices.Contains(XPLTypes, pkt.Type) {
+				return XPLPacket{}, packetError(RuleMessageType, i+1, "%q", lines[i])
+			}
+		} else {
+			if err := validateSchema(name); err != nil {
+				return XPLPacket{}, packetError(RuleSchema, i+1, "%q: %s", lines[i], err.Error())
+			}
+			pkt.MessageType = name
+		}
+		i += 2
+
+		closed := false
+		for ; i < len(lines); i++ {
+			if lines[i] == "}" {
+				closed = true
+				i++
+				break
+			}
+			key, value, found := strings.Cut(lines[i], "=")
+			if !found {
+				return XPLPacket{}, packetError(RuleKeyValue, i+1, "%q", lines[i])
 			}
-			cpt++
-		} else if !isOpen {
-			if cpt == 0 {
-				pkt.Type = XPLType(x)
-			} else if cpt == 1 {
-				pkt.MessageType = x
+			key = strings.ToLower(key)
+			if err := validateKey(key); err != nil {
+				return XPLPacket{}, packetError(RuleKey, i+1, "%q: %s", key, err.Error())
+			}
+			if err := validateValue(value); err != nil {
+				return XPLPacket{}, packetError(RuleValue, i+1, "%s: %s", key, err.Error())
+			}
+			if block == 0 {
+				header.Add(key, value)
 			} else {
-				slog.Warn("invalid xpl packet: too much message types")
-				return XPLPacket{}, ErrInvalidPacket
+				pkt.Data.Add(key, value)
 			}
-		} else {
-			kv := strings.Split(x, "=")
-			if len(kv) != 2 {
-				slog.Warn("invalid xpl packet: invalid key/value pair")
-				return XPLPacket{}, ErrInvalidPacket
+		}
+		if !closed {
+			return XPLPacket{}, packetError(RuleStructure, i, "missing '}'")
+		}
+	}
+	for ; i < len(lines); i++ {
+		if lines[i] != "" {
+			return XPLPacket{}, packetError(RuleStructure, i+1, "unexpected data after the message body")
+		}
+	}
+	if pkt.Data == nil {
+		pkt.Data = Body{}
+	}
+
+	err := decodeHeader(&pkt, header)
+	if err != nil {
+		return XPLPacket{}, err
+	}
+	return pkt, nil
+}
+
+func decodeHeader(pkt *XPLPacket, header Body) error {
+	seen := map[string]bool{}
+	for _, kv := range header {
+		if seen[kv.Key] {
+			return packetError(RuleHeader, 0, "duplicated key %q", kv.Key)
+		}
+		seen[kv.Key] = true
+		switch kv.Key {
+		case "hop":
+			hop, err := strconv.Atoi(kv.Value)
+			if err != nil || hop < 1 || hop > maxHop {
+				return packetError(RuleHop, 0, "%q is not between 1 and %d", kv.Value, maxHop)
+			}
+			pkt.Hop = hop
+		case "source":
+			src := strings.ToLower(kv.Value)
+			if err := validateSource(src); err != nil {
+				return packetError(RuleSource, 0, "%q: %s", kv.Value, err.Error())
+			}
+			pkt.Source = src
+		case "target":
+			target := strings.ToLower(kv.Value)
+			if err := validateTarget(target); err != nil {
+				return packetError(RuleTarget, 0, "%q: %s", kv.Value, err.Error())
 			}
-			xplData[kv[0]] = kv[1]
+			pkt.Target = target
+		default:
+			return packetError(RuleHeader, 0, "unknown key %q", kv.Key)
+		}
+	}
+	for _, k := range []string{"hop", "source", "target"} {
+		if !seen[k] {
+			return packetError(RuleHeader, 0, "missing %s", k)
 		}
 	}
+	return nil
+}
 
-	if !slices.Contains(XPLTypes, pkt.Type) {
-		return XPLPacket{}, ErrInvalidPacket
+// vendor-device.instance
+func validateSource(src string) error {
+	vd, instance, found := strings.Cut(src, ".")
+	if !found {
+		return errors.New("expected vendor-device.instance")
+	}
+	vendor, device, found := strings.Cut(vd, "-")
+	if !found {
+		return errors.New("expected vendor-device.instance")
+	}
+	if err := validateName("vendor", vendor, maxVendorLen, false); err != nil {
+		return err
+	}
+	if err := validateName("device", device, maxDeviceLen, false); err != nil {
+		return err
 	}
+	return validateName("instance", instance, maxInstanceLen, true)
+}
 
-	h, ok := xplHeader["hop"]
-	if !ok {
-		slog.Warn("invalid xpl packet: invalid packet type")
-		return XPLPacket{}, ErrInvalidPacket
+// *, vendor-device.instance or xpl-group.name
+func validateTarget(target string) error {
+	if target == "*" {
+		return nil
 	}
-	hop, err := strconv.Atoi(h)
-	if err != nil {
-		slog.Warn("invalid xpl packet: cannot parse hop")
-		return XPLPacket{}, ErrInvalidPacket
+	if group, found := strings.CutPrefix(target, groupPrefix); found {
+		return validateName("group", group, maxInstanceLen, true)
 	}
-	pkt.Hop = hop
+	return validateSource(target)
+}
 
-	src, ok := xplHeader["source"]
-	if !ok {
-		slog.Warn("invalid xpl packet: no source")
-		return XPLPacket{}, ErrInvalidPacket
+// class.type
+func validateSchema(schema string) error {
+	class, tp, found := strings.Cut(schema, ".")
+	if !found {
+		return errors.New("expected class.type")
 	}
-	pkt.Source = src
+	if err := validateName("class", class, maxClassLen, true); err != nil {
+		return err
+	}
+	return validateName("type", tp, maxTypeLen, true)
+}
 
-	target, ok := xplHeader["target"]
-	if !ok {
-		slog.Warn("invalid xpl packet: no target")
-		return XPLPacket{}, ErrInvalidPacket
+func validateKey(key string) error {
+	return validateName("key", key, maxKeyLen, true)
+}
+
+func validateValue(value string) error {
+	if len(value) > maxValueLen {
+		return fmt.Errorf("value longer than %d characters", maxValueLen)
 	}
-	pkt.Target = target
+	for _, c := range value {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	return nil
+}
 
-	return pkt, nil
+func validateName(name string, value string, maxLen int, allowHyphen bool) error {
+	if value == "" {
+		return fmt.Errorf("empty %s", name)
+	}
+	if len(value) > maxLen {
+		return fmt.Errorf("%s longer than %d characters", name, maxLen)
+	}
+	for _, c := range value {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && (c != '-' || !allowHyphen) {
+			return fmt.Errorf("invalid character %q in %s", c, name)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,194 @@
+package xpl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testPacket = "xpl-trig\n{\nhop=1\nsource=rfxcom-lan.0a1b2c\ntarget=*\n}\nac.basic\n{\naddress=0x123456\nunit=1\ncommand=on\n}\n"
+
+func TestDecodePacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		source string
+		schema string
+		body   Body
+	}{
+		{
+			name:   "basic",
+			data:   testPacket,
+			source: "rfxcom-lan.0a1b2c",
+			schema: "ac.basic",
+			body:   Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}},
+		},
+		{
+			name:   "value containing =",
+			data:   "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\ntext=a=b=c\n}\n",
+			source: "acme-app.x",
+			schema: "log.basic",
+			body:   Body{{"text", "a=b=c"}},
+		},
+		{
+			name:   "repeated keys",
+			data:   "xpl-cmnd\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\nconfig.response\n{\ngroup=xpl-group.a\ngroup=xpl-group.b\n}\n",
+			source: "acme-app.x",
+			schema: "config.response",
+			body:   Body{{"group", "xpl-group.a"}, {"group", "xpl-group.b"}},
+		},
+		{
+			name:   "crlf line endings",
+			data:   strings.ReplaceAll(testPacket, "\n", "\r\n"),
+			source: "rfxcom-lan.0a1b2c",
+			schema: "ac.basic",
+			body:   Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}},
+		},
+		{
+			name:   "uppercase names",
+			data:   "XPL-TRIG\n{\nhop=1\nsource=RFXCOM-LAN.0A1B2C\ntarget=*\n}\nAC.BASIC\n{\nUNIT=1\n}\n",
+			source: "rfxcom-lan.0a1b2c",
+			schema: "ac.basic",
+			body:   Body{{"unit", "1"}},
+		},
+		{
+			name:   "empty body",
+			data:   "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\nhbeat.end\n{\n}\n",
+			source: "acme-app.x",
+			schema: "hbeat.end",
+			body:   Body{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := DecodePacket(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if pkt.Source != tt.source || pkt.MessageType != tt.schema {
+				t.Errorf("got source %q schema %q, want %q %q", pkt.Source, pkt.MessageType, tt.source, tt.schema)
+			}
+			if len(pkt.Data) != len(tt.body) {
+				t.Fatalf("got body %v, want %v", pkt.Data, tt.body)
+			}
+			for i := range tt.body {
+				if pkt.Data[i] != tt.body[i] {
+					t.Errorf("got body %v, want %v", pkt.Data, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePacketErrors(t *testing.T) {
+	header := "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\n"
+	tests := []struct {
+		name string
+		data string
+		rule PacketRule
+	}{
+		{"empty", "", RuleStructure},
+		{"unknown type", "xpl-foo\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleMessageType},
+		{"missing hop", "xpl-stat\n{\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleHeader},
+		{"duplicated header key", "xpl-stat\n{\nhop=1\nhop=1\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleHeader},
+		{"unknown header key", "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=*\nfoo=bar\n}\nlog.basic\n{\n}\n", RuleHeader},
+		{"hop too low", "xpl-stat\n{\nhop=0\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleHop},
+		{"hop too high", "xpl-stat\n{\nhop=10\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleHop},
+		{"source without instance", "xpl-stat\n{\nhop=1\nsource=acme-app\ntarget=*\n}\nlog.basic\n{\n}\n", RuleSource},
+		{"vendor too long", "xpl-stat\n{\nhop=1\nsource=vendor123-app.x\ntarget=*\n}\nlog.basic\n{\n}\n", RuleSource},
+		{"invalid target", "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=foo\n}\nlog.basic\n{\n}\n", RuleTarget},
+		{"invalid schema", header + "logbasic\n{\n}\n", RuleSchema},
+		{"missing =", header + "log.basic\n{\ntext\n}\n", RuleKeyValue},
+		{"key too long", header + "log.basic\n{\nabcdefghijklmnopq=1\n}\n", RuleKey},
+		{"value too long", header + "log.basic\n{\ntext=" + strings.Repeat("a", maxValueLen+1) + "\n}\n", RuleValue},
+		{"non ascii value", header + "log.basic\n{\ntext=café\n}\n", RuleValue},
+		{"missing }", header + "log.basic\n{\ntext=a", RuleStructure},
+		{"truncated body", header + "log.basic\n{\ntext=a\n", RuleKeyValue},
+		{"missing {", header + "log.basic\ntext=a\n}\n", RuleStructure},
+		{"data after the body", header + "log.basic\n{\n}\nfoo\n", RuleStructure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodePacket(tt.data)
+			var perr *PacketError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got error %v, want a PacketError", err)
+			}
+			if perr.Rule != tt.rule {
+				t.Errorf("got rule %q, want %q (%s)", perr.Rule, tt.rule, err)
+			}
+			if !errors.Is(err, ErrInvalidPacket) {
+				t.Errorf("error does not wrap ErrInvalidPacket")
+			}
+		})
+	}
+}
+
+func TestDecodeValueLengthLimit(t *testing.T) {
+	data := "xpl-stat\n{\nhop=1\nsource=acme-app.x\ntarget=*\n}\nlog.basic\n{\ntext=" + strings.Repeat("a", maxValueLen) + "\n}\n"
+	pkt, err := DecodePacket(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(pkt.Data.Get("text")) != maxValueLen {
+		t.Errorf("got a value of %d characters, want %d", len(pkt.Data.Get("text")), maxValueLen)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []string{
+		testPacket,
+		"xpl-stat\n{\nhop=9\nsource=acme-app.instance-1\ntarget=xpl-group.living\n}\nlog.basic\n{\ntext=a=b\ntext=c\nempty=\n}\n",
+		"xpl-cmnd\n{\nhop=1\nsource=xpl2mqtt-bridge.default\ntarget=rfxcom-lan.0a1b2c\n}\nhbeat.end\n{\n}\n",
+	}
+	for _, data := range tests {
+		pkt, err := DecodePacket(data)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %q: %s", data, err)
+		}
+		res, err := EncodePacket(pkt)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %q: %s", data, err)
+		}
+		if res != data {
+			t.Errorf("got %q, want %q", res, data)
+		}
+	}
+}
+
+func TestValidatePacket(t *testing.T) {
+	valid := XPLPacket{Type: TypeCmnd, Hop: 1, Source: "acme-app.x", Target: "*", MessageType: "ac.basic", Data: Body{{"unit", "1"}}}
+	tests := []struct {
+		name   string
+		update func(*XPLPacket)
+		rule   PacketRule
+	}{
+		{"valid", func(p *XPLPacket) {}, ""},
+		{"unknown type", func(p *XPLPacket) { p.Type = "xpl-foo" }, RuleMessageType},
+		{"hop too high", func(p *XPLPacket) { p.Hop = maxHop + 1 }, RuleHop},
+		{"instance too long", func(p *XPLPacket) { p.Source = "acme-app." + strings.Repeat("a", maxInstanceLen+1) }, RuleSource},
+		{"uppercase source", func(p *XPLPacket) { p.Source = "ACME-app.x" }, RuleSource},
+		{"group target", func(p *XPLPacket) { p.Target = "xpl-group.a" }, ""},
+		{"class too long", func(p *XPLPacket) { p.MessageType = "abcdefghi.basic" }, RuleSchema},
+		{"invalid key", func(p *XPLPacket) { p.Data = Body{{"a b", "1"}} }, RuleKey},
+		{"value too long", func(p *XPLPacket) { p.Data = Body{{"a", strings.Repeat("a", maxValueLen+1)}} }, RuleValue},
+		{"newline in value", func(p *XPLPacket) { p.Data = Body{{"a", "a\nb=c"}} }, RuleValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := valid
+			tt.update(&pkt)
+			_, err := EncodePacket(pkt)
+			if tt.rule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			var perr *PacketError
+			if !errors.As(err, &perr) || perr.Rule != tt.rule {
+				t.Errorf("got error %v, want rule %q", err, tt.rule)
+			}
+		})
+	}
+}
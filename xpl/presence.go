@@ -0,0 +1,148 @@
+package xpl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// xpl device seen through its heartbeats
+type XPLDevice struct {
+	Source   string    `json:"source"`
+	IP       string    `json:"ip,omitempty"`
+	Port     int       `json:"port,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Interval int       `json:"interval"` // in minutes
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
+
+var devices = map[string]*XPLDevice{}
+var devicesLock sync.Mutex
+
+// how often the devices are checked for missed heartbeats
+const presenceCheckInterval = 30 * time.Second
+
+func DeviceAvailabilityTopic(source string) string {
+	return fmt.Sprintf("%s/devices/%s/availability", cmd.ConfigData.MqttBaseTopic, source)
+}
+
+func deviceInfoTopic(source string) string {
+	return fmt.Sprintf("%s/devices/%s/info", cmd.ConfigData.MqttBaseTopic, source)
+}
+
+func isKnownDevice(source string) bool {
+	devicesLock.Lock()
+	defer devicesLock.Unlock()
+	_, ok := devices[source]
+	return ok
+}
+
+// whether the device stopped sending heartbeats, false if it never sent one
+func isOfflineDevice(source string) bool {
+	devicesLock.Lock()
+	defer devicesLock.Unlock()
+	dev, ok := devices[source]
+	return ok && !dev.Online
+}
+
+func updateDevice(pkt *XPLPacket, c *mqtt.Client) {
+	interval, err := strconv.Atoi(pkt.Data.Get("interval"))
+	if err != nil || interval <= 0 {
+		interval = 5
+	}
+	ip := pkt.Data.Get("remote-ip")
+	if ip == "" {
+		ip = pkt.Data.Get("ip")
+	}
+	if ip == "" && pkt.RemoteAddr != nil {
+		ip = pkt.RemoteAddr.IP.String()
+	}
+	lastSeen := pkt.Received
+	if lastSeen.IsZero() {
+		lastSeen = time.Now()
+	}
+
+	devicesLock.Lock()
+	dev, ok := devices[pkt.Source]
+	if !ok {
+		dev = &XPLDevice{Source: pkt.Source}
+		devices[pkt.Source] = dev
+		slog.Info("new xpl device", "source", pkt.Source, "ip", ip)
+		if isGateway(pkt.Source) {
+			slog.Info("xpl gateway discovered", "source", pkt.Source, "ip", ip)
+		}
+	}
+	port, _ := strconv.Atoi(pkt.Data.Get("port"))
+	changed := !dev.Online || dev.IP != ip || dev.Port != port || dev.Version != pkt.Data.Get("version")
+	dev.IP = ip
+	dev.Port = port
+	dev.Version = pkt.Data.Get("version")
+	dev.Interval = interval
+	dev.LastSeen = lastSeen
+	dev.Online = true
+	info := *dev
+	devicesLock.Unlock()
+
+	if changed {
+		publishDevice(info, c)
+	}
+}
+
+func removeDevice(source string, c *mqtt.Client) {
+	devicesLock.Lock()
+	dev, ok := devices[source]
+	if !ok || !dev.Online {
+		devicesLock.Unlock()
+		return
+	}
+	dev.Online = false
+	info := *dev
+	devicesLock.Unlock()
+
+	slog.Info("xpl device offline", "source", source)
+	publishDevice(info, c)
+}
+
+func publishDevice(dev XPLDevice, c *mqtt.Client) {
+	state := "offline"
+	if dev.Online {
+		state = "online"
+	}
+	sendMqttPacketRetained(c, DeviceAvailabilityTopic(dev.Source), state)
+	data, err := json.Marshal(dev)
+	if err != nil {
+		slog.Error("error encoding xpl device", "error", err.Error())
+		return
+	}
+	sendMqttPacketRetained(c, deviceInfoTopic(dev.Source), string(data))
+}
+
+// marks offline the devices which missed two heartbeats
+func watchDevices(ctx context.Context, c *mqtt.Client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(presenceCheckInterval):
+		}
+		offline := []string{}
+		devicesLock.Lock()
+		for source, dev := range devices {
+			if dev.Online && time.Since(dev.LastSeen) > 2*time.Duration(dev.Interval)*time.Minute {
+				offline = append(offline, source)
+			}
+		}
+		devicesLock.Unlock()
+		for _, source := range offline {
+			removeDevice(source, c)
+		}
+	}
+}
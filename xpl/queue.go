@@ -0,0 +1,225 @@
+package xpl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// how often the queue depth is checked for publication
+const txDepthInterval = time.Second
+
+var ErrQueueFull = errors.New("xpl transmit queue is full")
+var ErrQueueClosed = errors.New("xpl transmit queue is closed")
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// priority of the commands sent for a schema, PriorityNormal if not listed
+var schemaPriorities = map[string]Priority{
+	"x10.security": PriorityHigh,
+}
+
+type txJob struct {
+	data      []byte
+	addrs     []*net.UDPAddr
+	remaining int
+	attempts  int
+	sent      int   // attempts sent to at least one address
+	err       error // last send error
+	// called once every repeat has been sent, with an error if none of them could be sent
+	done func(attempts int, err error)
+}
+
+// transmit queue, each packet is sent several times and the repeats of different
+// packets are interleaved, with a global spacing to respect the RF airtime
+type txQueue struct {
+	lock   sync.Mutex
+	jobs   [PriorityHigh + 1][]*txJob
+	notify chan struct{}
+	closed chan struct{}
+	// closed and recreated each time the queue becomes empty
+	empty chan struct{}
+	mqtt  *mqtt.Client
+}
+
+func newTxQueue(client *mqtt.Client) *txQueue {
+	return &txQueue{
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		empty:  make(chan struct{}),
+		mqtt:   client,
+	}
+}
+
+func TxQueueTopic() string {
+	return fmt.Sprintf("%s/bridge/tx_queue", cmd.ConfigData.MqttBaseTopic)
+}
+
+// number of transmissions waiting in the queue, repeats included
+func (q *txQueue) depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.depthLocked()
+}
+
+func (q *txQueue) depthLocked() int {
+	d := 0
+	for _, jobs := range q.jobs {
+		for _, j := range jobs {
+			d += j.remaining
+		}
+	}
+	return d
+}
+
+func (q *txQueue) push(job *txJob, prio Priority) error {
+	q.lock.Lock()
+	select {
+	case <-q.closed:
+		q.lock.Unlock()
+		return ErrQueueClosed
+	default:
+	}
+	if q.depthLocked()+job.remaining > cmd.ConfigData.TxQueueSize {
+		q.lock.Unlock()
+		return ErrQueueFull
+	}
+	q.jobs[prio] = append(q.jobs[prio], job)
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sends one repeat of the first job with the highest priority, the job goes back at the end of its queue
+// if it still has repeats to send
+func (q *txQueue) sendNext(send func([]byte, *net.UDPAddr) error) bool {
+	q.lock.Lock()
+	var job *txJob
+	last := false
+	for prio := PriorityHigh; prio >= PriorityLow; prio-- {
+		if len(q.jobs[prio]) > 0 {
+			job = q.jobs[prio][0]
+			q.jobs[prio] = q.jobs[prio][1:]
+			job.remaining--
+			job.attempts++
+			last = job.remaining == 0
+			if job.remaining > 0 {
+				q.jobs[prio] = append(q.jobs[prio], job)
+			}
+			break
+		}
+	}
+	if job == nil {
+		close(q.empty)
+		q.empty = make(chan struct{})
+		q.lock.Unlock()
+		return false
+	}
+	q.lock.Unlock()
+
+	ok := false
+	for _, addr := range job.addrs {
+		err := send(job.data, addr)
+		if err != nil {
+			slog.Error("error sending xpl packet", "address", addr.String(), "attempt", job.attempts, "error", err.Error())
+			job.err = err
+		} else {
+			ok = true
+		}
+	}
+	if ok {
+		job.sent++
+	}
+	if last && job.done != nil {
+		if job.sent > 0 {
+			job.done(job.attempts, nil)
+		} else {
+			job.done(job.attempts, job.err)
+		}
+	}
+	return true
+}
+
+func (q *txQueue) run(send func([]byte, *net.UDPAddr) error) {
+	for {
+		select {
+		case <-q.closed:
+			return
+		default:
+		}
+		if !q.sendNext(send) {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.closed:
+				return
+			}
+		}
+		time.Sleep(cmd.ConfigData.TxSpacing)
+	}
+}
+
+// waits until every queued packet has been sent, returns false on timeout
+func (q *txQueue) drain(timeout time.Duration) bool {
+	q.lock.Lock()
+	if q.depthLocked() == 0 {
+		q.lock.Unlock()
+		return true
+	}
+	empty := q.empty
+	q.lock.Unlock()
+	select {
+	case <-empty:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// stops the queue, the packets still queued are dropped without calling their done callbacks
+func (q *txQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	close(q.closed)
+	for prio := range q.jobs {
+		q.jobs[prio] = nil
+	}
+}
+
+// publishes the queue depth (retained) when it changed, at most once per txDepthInterval
+func (q *txQueue) watchDepth(ctx context.Context) {
+	if q.mqtt == nil {
+		return
+	}
+	last := -1
+	for {
+		d := q.depth()
+		if d != last {
+			sendMqttPacketRetained(q.mqtt, TxQueueTopic(), strconv.Itoa(d))
+			last = d
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(txDepthInterval):
+		}
+	}
+}
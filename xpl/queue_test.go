@@ -0,0 +1,45 @@
+package xpl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+func TestTxQueueClose(t *testing.T) {
+	old := cmd.ConfigData
+	t.Cleanup(func() { cmd.ConfigData = old })
+	cmd.ConfigData.TxQueueSize = 10
+	cmd.ConfigData.TxSpacing = time.Millisecond
+
+	q := newTxQueue(nil)
+	called := false
+	job := &txJob{data: []byte("x"), addrs: []*net.UDPAddr{{IP: net.IPv4bcast, Port: XPLPort}}, remaining: 5, done: func(int, error) { called = true }}
+	if err := q.push(job, PriorityNormal); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	q.close()
+	if d := q.depth(); d != 0 {
+		t.Errorf("got depth %d after close, want 0", d)
+	}
+
+	sent := 0
+	stopped := make(chan struct{})
+	go func() {
+		q.run(func([]byte, *net.UDPAddr) error { sent++; return nil })
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return after close")
+	}
+	if sent != 0 || called {
+		t.Errorf("got %d packets sent and done called %v after close, want none", sent, called)
+	}
+	if err := q.push(job, PriorityNormal); err != ErrQueueClosed {
+		t.Errorf("got error %v, want ErrQueueClosed", err)
+	}
+}
@@ -0,0 +1,76 @@
+package xpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// json representation of a xpl packet, used by the raw topics
+type RawPacket struct {
+	Type     XPLType    `json:"type"`
+	Hop      int        `json:"hop"`
+	Source   string     `json:"source"`
+	Target   string     `json:"target"`
+	Schema   string     `json:"schema"`
+	Body     Body       `json:"body"`
+	Received *time.Time `json:"received,omitempty"`
+	IP       string     `json:"ip,omitempty"`
+}
+
+func RawTopic(schema string) string {
+	return fmt.Sprintf("%s/raw/%s", cmd.ConfigData.MqttBaseTopic, schema)
+}
+
+func RawCommandTopic() string {
+	return RawTopic("set")
+}
+
+func sendRawPacket(pkt *XPLPacket, c *mqtt.Client) {
+	raw := RawPacket{
+		Type:   pkt.Type,
+		Hop:    pkt.Hop,
+		Source: pkt.Source,
+		Target: pkt.Target,
+		Schema: pkt.MessageType,
+		Body:   pkt.Data,
+	}
+	if !pkt.Received.IsZero() {
+		raw.Received = &pkt.Received
+	}
+	if pkt.RemoteAddr != nil {
+		raw.IP = pkt.RemoteAddr.IP.String()
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		slog.Error("error encoding raw xpl packet", "error", err.Error())
+		return
+	}
+	sendMqttPacket(c, RawTopic(pkt.MessageType), string(data))
+}
+
+func processRawCommand(payload string, srv *Server) error {
+	raw := RawPacket{}
+	err := json.Unmarshal([]byte(payload), &raw)
+	if err != nil {
+		return commandError("%s", err.Error())
+	}
+	if !slices.Contains(XPLTypes, raw.Type) || raw.Source == "" || raw.Target == "" || raw.Schema == "" {
+		return commandError("type, source, target and schema are required")
+	}
+	p := XPLPacket{
+		Type:        raw.Type,
+		Hop:         raw.Hop,
+		Source:      raw.Source,
+		Target:      raw.Target,
+		MessageType: raw.Schema,
+		Data:        raw.Body,
+	}
+	slog.Debug("sending raw xpl packet", "packet", p)
+	return srv.Write(&p, cmd.ConfigData.BroadcastAddress, currentConfig().Retries)
+}
@@ -0,0 +1,223 @@
+package xpl
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// parameters whose last command is re-sent, by schema
+// the commands of a group replace each other (ex: a brightness preset also switches the plug on)
+var reassertParams = map[string][][]string{
+	"ac.basic":      {{"switch", "brightness"}},
+	"x10.basic":     {{"switch", "brightness"}},
+	"x10.security":  {{"alarm"}, {"switch"}},
+	"control.basic": {{"switch"}},
+}
+
+// alarm commands which are re-sent, by payload: a triggered alarm is never re-sent
+var reassertAlarmCommands = map[string]string{
+	"ARM_HOME": "arm-home",
+	"ARM_AWAY": "arm-away",
+	"DISARM":   "disarm",
+}
+
+// how often the commands are checked for re-sends
+const reassertCheckInterval = 10 * time.Second
+
+// maximum delay between two re-sends when it is doubled after each one
+const maxReassertDelay = 7 * 24 * time.Hour
+
+// last command of each actuator parameter, by command topic, guarded by statesLock
+var commands = map[Topic]*storedState{}
+
+// parameters replaced by a command on the topic, nil if its commands are not re-sent
+func reassertGroup(topic Topic) []string {
+	if !slices.Contains(cmd.ConfigData.ReassertSchemas, topic.MessageType) {
+		return nil
+	}
+	for _, group := range reassertParams[topic.MessageType] {
+		if slices.Contains(group, topic.DeviceParam) {
+			return group
+		}
+	}
+	return nil
+}
+
+// whether the command can be re-sent, the alarm triggers are not
+func isReassertable(topic Topic, value string) bool {
+	if topic.MessageType == "x10.security" && topic.DeviceParam == "alarm" {
+		_, ok := reassertAlarmCommands[value]
+		return ok
+	}
+	return true
+}
+
+// delay before the next re-send, doubled after each one when the number of re-sends is limited
+func reassertDelay(sends int) time.Duration {
+	if cmd.ConfigData.ReassertCount > 0 {
+		// the delay is capped to avoid overflowing time.Duration
+		delay := cmd.ConfigData.ReassertInterval
+		for i := 0; i < sends && delay < maxReassertDelay; i++ {
+			delay *= 2
+		}
+		return min(delay, maxReassertDelay)
+	}
+	return cmd.ConfigData.ReassertInterval
+}
+
+// schedules the first re-send of a command, statesLock must be held
+func scheduleCommand(c *storedState) {
+	c.sends = 0
+	c.next = time.Time{}
+	if cmd.ConfigData.ReassertInterval > 0 {
+		c.next = time.Now().Add(reassertDelay(0))
+	}
+}
+
+// remembers the last command of the parameter, replacing the commands of its group
+func setCommand(topic Topic, value string, t time.Time) {
+	group := reassertGroup(topic)
+	if group == nil || !isReassertable(topic, value) {
+		return
+	}
+	topic.Action = "set"
+	for _, param := range group {
+		other := topic
+		other.DeviceParam = param
+		delete(commands, other)
+	}
+	c := &storedState{
+		Schema:     topic.MessageType,
+		DeviceType: topic.DeviceType,
+		DeviceID:   topic.DeviceID,
+		Param:      topic.DeviceParam,
+		Action:     "set",
+		Value:      value,
+		Time:       t,
+	}
+	scheduleCommand(c)
+	commands[topic] = c
+	statesChanged = true
+}
+
+// remembers a command sent by mqtt
+func rememberCommand(topic Topic, value string) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	setCommand(topic, value, time.Now())
+}
+
+// a state received from the network (ex: sent by a remote) replaces the last command of the parameter,
+// if a command was sent to its group
+func updateCommand(pkt *XPLPacket, topic Topic, value string, t time.Time) {
+	group := reassertGroup(topic)
+	if group == nil {
+		return
+	}
+	value, ok := commandPayload(pkt, topic, value)
+	if !ok {
+		return
+	}
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	for _, param := range group {
+		c, ok := commands[Topic{MessageType: topic.MessageType, DeviceType: topic.DeviceType, DeviceID: topic.DeviceID, DeviceParam: param, Action: "set"}]
+		if ok {
+			if c.Param != topic.DeviceParam || c.Value != value {
+				setCommand(topic, value, t)
+			}
+			return
+		}
+	}
+}
+
+// command payload setting a parameter to a state published by the decoders, false if there is none
+func commandPayload(pkt *XPLPacket, topic Topic, state string) (string, bool) {
+	payload := state
+	if topic.MessageType == "x10.security" && topic.DeviceParam == "alarm" {
+		// the alarm states are ambiguous (ex: armed_home is also published for normal),
+		// only the arm and disarm commands of the packet are learnt
+		payload = ""
+		for p, command := range reassertAlarmCommands {
+			if pkt.Data.Get("command") == command {
+				payload = p
+			}
+		}
+	}
+	enc, ok := encoders[topic.MessageType]
+	if !ok || payload == "" {
+		return "", false
+	}
+	_, err := enc(topic, payload)
+	return payload, err == nil
+}
+
+// loads a command from the state file, statesLock must be held
+func loadCommand(c *storedState) {
+	if reassertGroup(c.topic()) == nil || !isReassertable(c.topic(), c.Value) {
+		return
+	}
+	scheduleCommand(c)
+	commands[c.topic()] = c
+}
+
+// re-sends a command through its encoder, with a low priority to not delay the new commands
+func resendCommand(srv *Server, topic Topic, value string) {
+	enc, ok := encoders[topic.MessageType]
+	if !ok {
+		return
+	}
+	data, err := enc(topic, value)
+	if err == nil {
+		err = sendXplPacketPriority(srv, topic, data, PriorityLow, nil)
+	}
+	if err != nil {
+		slog.Warn("error re-sending command", "topic", topic.String(), "error", err.Error())
+		return
+	}
+	slog.Debug("command re-sent", "topic", topic.String(), "value", value)
+}
+
+// re-sends the commands which are due, or all of them
+func reassertCommands(srv *Server, all bool) {
+	due := map[Topic]string{}
+	now := time.Now()
+	statesLock.Lock()
+	for t, c := range commands {
+		if all || (!c.next.IsZero() && !now.Before(c.next)) {
+			due[t] = c.Value
+		}
+		if !c.next.IsZero() && !now.Before(c.next) {
+			c.sends++
+			c.next = now.Add(reassertDelay(c.sends))
+			if cmd.ConfigData.ReassertCount > 0 && c.sends >= cmd.ConfigData.ReassertCount {
+				c.next = time.Time{}
+			}
+		}
+	}
+	statesLock.Unlock()
+	for t, value := range due {
+		resendCommand(srv, t, value)
+	}
+}
+
+func (p *Server) runReassert(ctx context.Context) {
+	if len(cmd.ConfigData.ReassertSchemas) == 0 {
+		return
+	}
+	if cmd.ConfigData.ReassertOnStart {
+		reassertCommands(p, true)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reassertCheckInterval):
+		}
+		reassertCommands(p, false)
+	}
+}
@@ -0,0 +1,56 @@
+package xpl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+func TestAlarmReassert(t *testing.T) {
+	old := cmd.ConfigData
+	t.Cleanup(func() {
+		cmd.ConfigData = old
+		commands = map[Topic]*storedState{}
+	})
+	cmd.ConfigData.ReassertSchemas = []string{"x10.security"}
+	topic := Topic{MessageType: "x10.security", DeviceType: "x10sec", DeviceID: "0x12", DeviceParam: "alarm", Action: "set"}
+	received := func(command string) *XPLPacket {
+		return &XPLPacket{MessageType: "x10.security", Data: Body{{"command", command}, {"device", "0x12"}}}
+	}
+
+	tests := []struct {
+		name   string
+		update func()
+		want   string
+	}{
+		{"arm command", func() { rememberCommand(topic, "ARM_AWAY") }, "ARM_AWAY"},
+		{"trigger command", func() { rememberCommand(topic, "ARM_AWAY"); rememberCommand(topic, "TRIGGER") }, "ARM_AWAY"},
+		{"triggered panel", func() {
+			rememberCommand(topic, "ARM_AWAY")
+			updateCommand(received("panic"), topic, "triggered", time.Now())
+		}, "ARM_AWAY"},
+		{"normal panel", func() {
+			rememberCommand(topic, "ARM_AWAY")
+			updateCommand(received("normal"), topic, "armed_home", time.Now())
+		}, "ARM_AWAY"},
+		{"disarmed panel", func() {
+			rememberCommand(topic, "ARM_AWAY")
+			updateCommand(received("disarm"), topic, "disarmed", time.Now())
+		}, "DISARM"},
+		{"only a trigger", func() { rememberCommand(topic, "TRIGGER") }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands = map[Topic]*storedState{}
+			tt.update()
+			got := ""
+			if c, ok := commands[topic]; ok {
+				got = c.Value
+			}
+			if got != tt.want {
+				t.Errorf("got stored command %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package xpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	statusRejected    = "rejected"    // invalid command, or the transmit queue is full
+	statusFailed      = "failed"      // none of the repeats could be sent
+	statusSent        = "sent"        // every repeat has been sent, the schema has no confirmation
+	statusConfirmed   = "confirmed"   // every repeat has been sent and the network confirmed the command
+	statusUnconfirmed = "unconfirmed" // every repeat has been sent but no confirmation was received
+	statusTimeout     = "timeout"     // the repeats were not sent before the timeout
+)
+
+// schemas of the xpl-trig messages confirming a command, by command schema
+var confirmSchemas = map[string][]string{
+	"x10.basic":    {"x10.confirm", "x10.basic"},
+	"ac.basic":     {"ac.basic"},
+	"x10.security": {"x10.security"},
+}
+
+// result of a command sent with a request id
+type CommandResponse struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// command with a request id, waiting for its transmission and confirmation
+type request struct {
+	mqtt      *mqtt.Client
+	id        string
+	topic     string
+	command   Topic
+	body      Body // encoded command, compared with the confirmations
+	attempts  int
+	sent      bool
+	confirmed bool
+	finished  bool
+	timer     *time.Timer
+}
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var requests = map[*request]bool{}
+var requestsLock sync.Mutex
+
+func ResponseTopic(id string) string {
+	return fmt.Sprintf("%s/bridge/response/%s", cmd.ConfigData.MqttBaseTopic, id)
+}
+
+// the payload of a command is either the value, or a json object with the value and a request id:
+// {"value": "ON", "id": "42"}
+func parseCommandPayload(payload string) (string, string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return payload, "", nil
+	}
+	var cmdPayload struct {
+		Value any    `json:"value"`
+		ID    string `json:"id"`
+	}
+	err := json.Unmarshal([]byte(payload), &cmdPayload)
+	if err != nil {
+		return "", "", commandError("invalid json payload: %s", err.Error())
+	}
+	if cmdPayload.ID != "" && !requestIDRegexp.MatchString(cmdPayload.ID) {
+		return "", "", commandError("the request id must be made of at most 64 letters, digits, '.', '_' or '-'")
+	}
+	switch v := cmdPayload.Value.(type) {
+	case string:
+		return v, cmdPayload.ID, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), cmdPayload.ID, nil
+	}
+	return "", "", commandError("the value of a json payload must be a string or a number")
+}
+
+func newRequest(c *mqtt.Client, id string, topic string, command Topic, body Body) *request {
+	r := &request{mqtt: c, id: id, topic: topic, command: command, body: body}
+	requestsLock.Lock()
+	requests[r] = true
+	r.timer = time.AfterFunc(cmd.ConfigData.CommandTimeout, r.timeout)
+	requestsLock.Unlock()
+	return r
+}
+
+// called by the transmit queue once every repeat has been sent
+func (r *request) transmitted(attempts int, err error) {
+	requestsLock.Lock()
+	r.attempts = attempts
+	r.sent = err == nil
+	confirmed := r.confirmed
+	requestsLock.Unlock()
+	if err != nil {
+		r.finish(statusFailed, err)
+	} else if confirmed {
+		r.finish(statusConfirmed, nil)
+	} else if _, ok := confirmSchemas[r.command.MessageType]; !ok {
+		r.finish(statusSent, nil)
+	}
+}
+
+func (r *request) timeout() {
+	requestsLock.Lock()
+	sent := r.sent
+	requestsLock.Unlock()
+	if sent {
+		r.finish(statusUnconfirmed, nil)
+	} else {
+		r.finish(statusTimeout, nil)
+	}
+}
+
+// publishes the response of the request, only the first call has an effect
+func (r *request) finish(status string, err error) {
+	if r == nil {
+		return
+	}
+	requestsLock.Lock()
+	if r.finished {
+		requestsLock.Unlock()
+		return
+	}
+	r.finished = true
+	r.timer.Stop()
+	delete(requests, r)
+	res := CommandResponse{ID: r.id, Topic: r.topic, Status: status, Attempts: r.attempts, Time: time.Now()}
+	requestsLock.Unlock()
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	data, jerr := json.Marshal(res)
+	if jerr != nil {
+		slog.Error("error encoding command response", "error", jerr.Error())
+		return
+	}
+	sendMqttPacket(r.mqtt, ResponseTopic(r.id), string(data))
+}
+
+// confirms the pending requests of the device of a received xpl-trig message
+func confirmRequests(pkt *XPLPacket) {
+	if pkt.Type != TypeTrig {
+		return
+	}
+	id := packetDeviceID(pkt)
+	tp := packetDeviceType(pkt)
+	confirmed := []*request{}
+	requestsLock.Lock()
+	for r := range requests {
+		if r.confirmed || r.command.DeviceID != id || !slices.Contains(confirmSchemas[r.command.MessageType], pkt.MessageType) {
+			continue
+		}
+		if tp != "" && !strings.EqualFold(tp, r.command.DeviceType) {
+			continue
+		}
+		if !confirmsBody(r.body, pkt.Data) {
+			continue
+		}
+		r.confirmed = true
+		if r.sent {
+			confirmed = append(confirmed, r)
+		}
+	}
+	requestsLock.Unlock()
+	for _, r := range confirmed {
+		r.finish(statusConfirmed, nil)
+	}
+}
+
+// whether a confirmation reports the command that was sent: the same command,
+// and the same level when the confirmation has one
+func confirmsBody(sent Body, received Body) bool {
+	if !strings.EqualFold(sent.Get("command"), received.Get("command")) {
+		return false
+	}
+	level, ok := received.Lookup("level")
+	return !ok || !sent.Has("level") || level == sent.Get("level")
+}
+
+// device type of a confirmation as used in the command topics (unit, protocol or type), empty when the packet has none
+func packetDeviceType(pkt *XPLPacket) string {
+	switch pkt.MessageType {
+	case "ac.basic":
+		return pkt.Data.Get("unit")
+	case "x10.basic", "x10.confirm":
+		return pkt.Data.Get("protocol")
+	case "x10.security":
+		return pkt.Data.Get("type")
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package xpl
+
+import "testing"
+
+func TestConfirmRequests(t *testing.T) {
+	command := Topic{MessageType: "ac.basic", DeviceType: "1", DeviceID: "0x123456", DeviceParam: "switch", Action: "set"}
+	tests := []struct {
+		name      string
+		body      Body
+		trig      Body
+		confirmed bool
+	}{
+		{"same command", Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}}, Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}}, true},
+		{"other command", Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}}, Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "off"}}, false},
+		{"other unit", Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "on"}}, Body{{"address", "0x123456"}, {"unit", "2"}, {"command", "on"}}, false},
+		{"same level", Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "preset"}, {"level", "8"}}, Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "preset"}, {"level", "8"}}, true},
+		{"other level", Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "preset"}, {"level", "8"}}, Body{{"address", "0x123456"}, {"unit", "1"}, {"command", "preset"}, {"level", "3"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &request{command: command, body: tt.body}
+			requests = map[*request]bool{r: true}
+			t.Cleanup(func() { requests = map[*request]bool{} })
+			confirmRequests(&XPLPacket{Type: TypeTrig, MessageType: "ac.basic", Data: tt.trig})
+			if r.confirmed != tt.confirmed {
+				t.Errorf("got confirmed %v, want %v", r.confirmed, tt.confirmed)
+			}
+		})
+	}
+}
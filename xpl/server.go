@@ -1,24 +1,53 @@
 package xpl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/droso-hass/xpl2mqtt/cmd"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Server struct {
 	conn *net.UDPConn
-	stop bool
 	mqtt *mqtt.Client
+	hub  *hub
+	// in client mode, whether the local hub has relayed our heartbeat
+	hubFound atomic.Bool
+	mode     string
+	// false while the bridge waits for its configuration through config.response
+	configured     atomic.Bool
+	hbeatRequested atomic.Bool
+	tx             *txQueue
+	// configured interfaces, empty to use all of them
+	interfaces []*xplInterface
+	// ipv6 multicast group and its sockets, nil if disabled
+	group     net.IP
+	multicast []*multicastListener
+	heard     map[string]*xplInterface
+	heardLock sync.Mutex
+	// closed when the server starts stopping
+	stopping <-chan struct{}
 }
 
 var XPLPort = 3865
 
-func NewServer(port int, client *mqtt.Client) *Server {
+// maximum time spent sending the queued packets on shutdown
+const drainTimeout = 5 * time.Second
+
+func NewServer(port int, client *mqtt.Client, mode string) *Server {
+	// behind a hub, the xpl port belongs to the hub and a random one is used
+	if mode == "client" {
+		port = 0
+	}
+	// the socket is not bound to the xpl interfaces as it would not receive the broadcasts, the packets are filtered by read
 	listen, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatalf("unable to resolve udp address: %s", err.Error())
@@ -27,45 +56,170 @@ func NewServer(port int, client *mqtt.Client) *Server {
 	if err != nil {
 		log.Fatalf("unable to initialize UDPConn: %s", err.Error())
 	}
-	return &Server{
-		conn: conn,
-		stop: false,
-		mqtt: client,
+	srv := &Server{
+		conn:  conn,
+		mqtt:  client,
+		mode:  mode,
+		tx:    newTxQueue(client),
+		heard: map[string]*xplInterface{},
+	}
+	initGateways()
+	loadStates()
+	srv.interfaces, err = loadInterfaces(cmd.ConfigData.XPLInterfaces)
+	if err != nil {
+		log.Fatalf("unable to use network interfaces: %s", err.Error())
+	}
+	if cmd.ConfigData.XPLIPv6 {
+		srv.group = net.ParseIP(cmd.ConfigData.XPLMulticastGroup)
+		srv.multicast, err = listenMulticast(srv.group, XPLPort, srv.interfaces)
+		if err != nil {
+			log.Fatalf("unable to join xpl multicast group: %s", err.Error())
+		}
+	}
+	srv.configured.Store(loadConfig() || !cmd.ConfigData.XPLWaitConfig)
+	err = currentConfig().validate()
+	if err != nil {
+		log.Fatalf("invalid xpl configuration: %s", err.Error())
+	}
+	if mode == "hub" {
+		srv.hub = newHub()
 	}
+	return srv
 }
 
-func (p *Server) Stop() {
-	p.stop = true
+// receives xpl packets until ctx is cancelled, then sends hbeat.end, drains the
+// transmit queue and closes the sockets
+func (p *Server) Run(ctx context.Context) error {
+	p.stopping = ctx.Done()
+	go p.tx.run(p.send)
+	go p.tx.watchDepth(ctx)
+	go p.runHeartbeat(ctx)
+	go watchDevices(ctx, p.mqtt)
+	go watchCoverage(ctx, p.mqtt)
+	go watchStates(ctx)
+	go p.runReassert(ctx)
+
+	packets := make(chan received)
+	var readers sync.WaitGroup
+	readers.Add(1 + len(p.multicast))
+	go p.read(p.conn, nil, packets, &readers)
+	for _, l := range p.multicast {
+		go p.read(l.conn, l.iface, packets, &readers)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		slog.Info("stopping xpl server")
+		p.sendHeartbeatEnd()
+		if !p.tx.drain(drainTimeout) {
+			slog.Warn("xpl transmit queue not empty on shutdown", "depth", p.QueueDepth())
+		}
+		p.tx.close()
+		p.conn.Close()
+		for _, l := range p.multicast {
+			l.conn.Close()
+		}
+		readers.Wait()
+		saveStates()
+		close(stopped)
+	}()
+
+	for {
+		select {
+		case <-stopped:
+			return nil
+		case r := <-packets:
+			p.process(r)
+		}
+	}
 }
 
-func (p *Server) Run() error {
+// reads the packets of a socket until it is closed, iface is nil for the ipv4 socket
+func (p *Server) read(conn *net.UDPConn, iface *xplInterface, packets chan<- received, wg *sync.WaitGroup) {
+	defer wg.Done()
 	buffer := make([]byte, 2048)
-	for !p.stop {
-		recvSize, _, err := p.conn.ReadFrom(buffer)
+	for {
+		recvSize, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			slog.Debug("error receiving udp packet", "error", err.Error())
+			continue
 		}
 		if recvSize == 2048 {
 			slog.Warn("received udp message is the same size as the buffer, it may have been truncated")
 		}
 
-		pkt, err := DecodePacket(string(buffer[:recvSize]))
-		if err != nil {
-			slog.Warn("error decoding packet: " + err.Error())
-		} else {
-			ProcessXPL(&pkt, p.mqtt)
+		r := received{data: make([]byte, recvSize), addr: addr, iface: iface}
+		copy(r.data, buffer[:recvSize])
+		if iface == nil && len(p.interfaces) > 0 {
+			r.iface = p.interfaceOf(addr.IP)
+			// packets from the other networks are ignored, except the ones from local applications
+			if r.iface == nil && !addr.IP.IsLoopback() {
+				slog.Debug("ignoring udp packet received outside of the configured interfaces", "address", addr.String())
+				continue
+			}
 		}
+		packets <- r
 	}
-	return nil
 }
 
-func (p *Server) Write(pkt *XPLPacket, addr *net.UDPAddr, nbPackets int) error {
-	for i := 0; i < nbPackets; i++ {
-		_, err := p.conn.WriteTo([]byte(EncodePacket(*pkt)), addr)
-		if err != nil {
-			return err
+func (p *Server) process(r received) {
+	pkt, err := DecodePacket(string(r.data))
+	if p.hub != nil {
+		// a new client is registered before forwarding, so that it receives its own heartbeat back
+		if err == nil {
+			p.hub.process(&pkt)
 		}
-		time.Sleep(time.Millisecond * 100)
+		// the hub relays every datagram, including the ones the bridge cannot decode
+		p.hub.forward(p.conn, r.data)
+	}
+	if err != nil {
+		slog.Warn("error decoding packet: " + err.Error())
+		return
 	}
-	return nil
+	pkt.Received = time.Now()
+	pkt.RemoteAddr = r.addr
+	pkt.Interface = r.iface.name()
+	p.setHeardOn(&pkt, r.iface)
+	p.processHeartbeat(&pkt)
+	p.processConfig(&pkt)
+	if p.configured.Load() && Accepts(&pkt) {
+		ProcessXPL(&pkt, p.mqtt)
+	}
+}
+
+func BridgeStateTopic() string {
+	return fmt.Sprintf("%s/bridge/state", cmd.ConfigData.MqttBaseTopic)
+}
+
+func (p *Server) port() int {
+	return p.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// queues a packet to be sent nbPackets times, it never blocks
+func (p *Server) Write(pkt *XPLPacket, addr *net.UDPAddr, nbPackets int) error {
+	return p.WritePriority(pkt, addr, nbPackets, PriorityNormal)
+}
+
+func (p *Server) WritePriority(pkt *XPLPacket, addr *net.UDPAddr, nbPackets int, prio Priority) error {
+	return p.write(pkt, "", addr, nbPackets, prio, nil)
+}
+
+// device is the deviceKey of the device a command is sent to, empty for the other packets
+// done is called with the number of attempts once every repeat has been sent, it can be nil
+func (p *Server) write(pkt *XPLPacket, device string, addr *net.UDPAddr, nbPackets int, prio Priority, done func(int, error)) error {
+	data, err := EncodePacket(*pkt)
+	if err != nil {
+		return err
+	}
+	job := &txJob{data: []byte(data), addrs: p.destinations(pkt.Target, device, addr), remaining: nbPackets, done: done}
+	return p.tx.push(job, prio)
+}
+
+// number of transmissions waiting to be sent
+func (p *Server) QueueDepth() int {
+	return p.tx.depth()
 }
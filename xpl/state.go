@@ -0,0 +1,247 @@
+package xpl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// last value of a device parameter, or last command sent to it when Action is set
+type storedState struct {
+	Schema     string    `json:"schema"`
+	DeviceType string    `json:"device_type"`
+	DeviceID   string    `json:"device_id"`
+	Param      string    `json:"param"`
+	Action     string    `json:"action,omitempty"` // empty for states
+	Value      string    `json:"value"`
+	Time       time.Time `json:"time"`
+	// re-sends of a command since it was received, and time of the next one (zero if none)
+	sends int
+	next  time.Time
+}
+
+func (s *storedState) topic() Topic {
+	action := s.Action
+	if action == "" {
+		action = "state"
+	}
+	return Topic{MessageType: s.Schema, DeviceType: s.DeviceType, DeviceID: s.DeviceID, DeviceParam: s.Param, Action: action}
+}
+
+// last state of each device parameter, by state topic
+var states = map[Topic]*storedState{}
+var statesChanged bool
+var statesLock sync.Mutex
+
+// how often the states are saved when they changed
+const stateSaveInterval = time.Minute
+
+// json documents of the devices, by device topic
+var deviceStates = map[string]map[string]any{}
+
+// documents updated by the packet being decoded, published once it has been decoded
+var pendingStates = map[string]bool{}
+var deviceStatesLock sync.Mutex
+
+// topic of the json document of the device, the topic of its parameters without the parameter level
+func deviceStateTopic(topic Topic) string {
+	t := topic
+	t.DeviceParam = ""
+	t.Action = "state"
+	return t.String()
+}
+
+// publishes the value of a device parameter, or adds it to the json document of the device
+// pkt is nil for the optimistic states, which are not received from the device
+func publishState(c *mqtt.Client, pkt *XPLPacket, topic Topic, value string) {
+	lastSeen := time.Now()
+	if pkt != nil && !pkt.Received.IsZero() {
+		lastSeen = pkt.Received
+	}
+	storeState(topic, value, lastSeen)
+	if pkt != nil {
+		updateCommand(pkt, topic, value, lastSeen)
+	}
+	if !cmd.ConfigData.JsonState {
+		sendMqttPacket(c, topic.String(), value)
+		return
+	}
+	key := deviceStateTopic(topic)
+
+	deviceStatesLock.Lock()
+	defer deviceStatesLock.Unlock()
+	doc, ok := deviceStates[key]
+	if !ok {
+		doc = map[string]any{}
+		deviceStates[key] = doc
+	}
+	doc[topic.DeviceParam] = value
+	doc["last_seen"] = lastSeen
+	if pkt != nil {
+		doc["raw"] = pkt.Data
+	}
+	pendingStates[key] = true
+}
+
+// publishes the json documents updated since the last call
+func flushStates(c *mqtt.Client) {
+	deviceStatesLock.Lock()
+	defer deviceStatesLock.Unlock()
+	for key := range pendingStates {
+		data, err := json.Marshal(deviceStates[key])
+		if err != nil {
+			slog.Error("error encoding device state", "error", err.Error())
+			continue
+		}
+		sendMqttPacket(c, key, string(data))
+	}
+	clear(pendingStates)
+}
+
+// points the state topics of a discovery payload to the json document of the device
+func jsonStateConfig(data *HAConfig) {
+	if data.StateTopic != "" {
+		data.StateTopic, data.ValueTemplate = jsonStateTemplate(data.StateTopic)
+	}
+	if data.BrightnessStateTopic != "" {
+		data.BrightnessStateTopic, data.BrightnessValueTemplate = jsonStateTemplate(data.BrightnessStateTopic)
+	}
+}
+
+func jsonStateTemplate(stateTopic string) (string, string) {
+	t := Topic{}
+	if err := t.Parse(stateTopic); err != nil {
+		slog.Error("error parsing state topic", "topic", stateTopic, "error", err.Error())
+		return stateTopic, ""
+	}
+	return deviceStateTopic(t), fmt.Sprintf("{{ value_json['%s'] }}", t.DeviceParam)
+}
+
+func storeState(topic Topic, value string, t time.Time) {
+	topic.Action = "state"
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	states[topic] = &storedState{
+		Schema:     topic.MessageType,
+		DeviceType: topic.DeviceType,
+		DeviceID:   topic.DeviceID,
+		Param:      topic.DeviceParam,
+		Value:      value,
+		Time:       t,
+	}
+	statesChanged = true
+}
+
+// publishes again the last state of a device parameter, answering a get request
+func republishState(c *mqtt.Client, topic Topic) error {
+	topic.Action = "state"
+	statesLock.Lock()
+	st, ok := states[topic]
+	statesLock.Unlock()
+	if !ok {
+		return commandError("no state known for %s", topic.String())
+	}
+	if !cmd.ConfigData.JsonState {
+		sendMqttPacket(c, topic.String(), st.Value)
+		return nil
+	}
+	deviceStatesLock.Lock()
+	pendingStates[deviceStateTopic(topic)] = true
+	deviceStatesLock.Unlock()
+	flushStates(c)
+	return nil
+}
+
+func loadStates() {
+	if cmd.ConfigData.StateFile == "" {
+		return
+	}
+	data, err := os.ReadFile(cmd.ConfigData.StateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("error reading state file", "error", err.Error())
+		}
+		return
+	}
+	list := []*storedState{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		slog.Error("invalid state file", "error", err.Error())
+		return
+	}
+
+	statesLock.Lock()
+	deviceStatesLock.Lock()
+	for _, st := range list {
+		t := st.topic()
+		if st.Action == "set" {
+			loadCommand(st)
+			continue
+		}
+		states[t] = st
+		// the json documents are rebuilt without the raw body, which is not stored
+		key := deviceStateTopic(t)
+		doc, ok := deviceStates[key]
+		if !ok {
+			doc = map[string]any{}
+			deviceStates[key] = doc
+		}
+		doc[st.Param] = st.Value
+		if last, ok := doc["last_seen"].(time.Time); !ok || st.Time.After(last) {
+			doc["last_seen"] = st.Time
+		}
+	}
+	deviceStatesLock.Unlock()
+	statesLock.Unlock()
+	slog.Info("states loaded", "file", cmd.ConfigData.StateFile, "count", len(list))
+}
+
+// writes the states to the state file if they changed since the last call
+func saveStates() {
+	if cmd.ConfigData.StateFile == "" {
+		return
+	}
+	statesLock.Lock()
+	if !statesChanged {
+		statesLock.Unlock()
+		return
+	}
+	list := make([]storedState, 0, len(states)+len(commands))
+	for _, st := range states {
+		list = append(list, *st)
+	}
+	for _, c := range commands {
+		list = append(list, *c)
+	}
+	statesChanged = false
+	statesLock.Unlock()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		slog.Error("error encoding states", "error", err.Error())
+		return
+	}
+	err = os.WriteFile(cmd.ConfigData.StateFile, data, 0644)
+	if err != nil {
+		slog.Error("error writing state file", "error", err.Error())
+	}
+}
+
+func watchStates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stateSaveInterval):
+		}
+		saveStates()
+	}
+}
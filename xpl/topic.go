@@ -3,11 +3,14 @@ package xpl
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/droso-hass/xpl2mqtt/cmd"
 )
 
+// rendered with the topic template, by default:
 // xpl2mqtt/messagetype/device_type/device_id/device_parameter/action
 // ex: xpl2mqtt/sensor.basic/th-1/0x12345678/temp/state
 type Topic struct {
@@ -18,43 +21,193 @@ type Topic struct {
 	Action      string
 }
 
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// actions which can be renamed in the topics
+var topicActions = []string{"state", "set", "get"}
+
+// regexp matching the topic template, built on first use
+var topicRegexp *regexp.Regexp
+var topicRegexpOnce sync.Once
+
 func (t *Topic) String() string {
-	return fmt.Sprintf(
-		"%s/%s/%s/%s/%s/%s",
-		cmd.ConfigData.MqttBaseTopic,
-		t.MessageType,
-		t.DeviceType,
-		t.DeviceID,
-		t.DeviceParam,
-		t.Action,
-	)
+	fields := map[string]string{
+		"base":        cmd.ConfigData.MqttBaseTopic,
+		"schema":      t.MessageType,
+		"device_type": t.DeviceType,
+		"device_id":   t.DeviceID,
+		"alias":       t.alias(),
+		"param":       t.DeviceParam,
+		"action":      actionName(t.Action),
+	}
+	s := cmd.TopicPlaceholder.ReplaceAllStringFunc(cmd.ConfigData.TopicTemplate, func(p string) string {
+		return fields[p[1:len(p)-1]]
+	})
+	// the levels of the empty fields are removed, ex: the state action when it is renamed to an empty string
+	levels := []string{}
+	for _, l := range strings.Split(s, "/") {
+		if l != "" {
+			levels = append(levels, l)
+		}
+	}
+	return strings.Join(levels, "/")
 }
 
 func (t *Topic) StringO(o Topic) string {
-	return fmt.Sprintf(
-		"%s/%s/%s/%s/%s/%s",
-		cmd.ConfigData.MqttBaseTopic,
-		getStr(o.MessageType, t.MessageType),
-		getStr(o.DeviceType, t.DeviceType),
-		getStr(o.DeviceID, t.DeviceID),
-		getStr(o.DeviceParam, t.DeviceParam),
-		getStr(o.Action, t.Action),
-	)
+	m := Topic{
+		MessageType: getStr(o.MessageType, t.MessageType),
+		DeviceType:  getStr(o.DeviceType, t.DeviceType),
+		DeviceID:    getStr(o.DeviceID, t.DeviceID),
+		DeviceParam: getStr(o.DeviceParam, t.DeviceParam),
+		Action:      getStr(o.Action, t.Action),
+	}
+	return m.String()
 }
 
 func (t *Topic) Parse(topic string) error {
-	data := strings.Split(topic[len(cmd.ConfigData.MqttBaseTopic)+1:], "/")
-	if len(data) != 5 {
-		return errors.New("invalid topic")
-	}
-	t.MessageType = data[0]
-	t.DeviceType = data[1]
-	t.DeviceID = data[2]
-	t.DeviceParam = data[3]
-	t.Action = data[4]
+	re := topicPattern()
+	match := re.FindStringSubmatch(topic)
+	if match == nil {
+		return fmt.Errorf("%w: does not match %s", ErrInvalidTopic, cmd.ConfigData.TopicTemplate)
+	}
+	fields := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+
+	t.Action = ""
+	for _, a := range topicActions {
+		if actionName(a) == fields["action"] {
+			t.Action = a
+		}
+	}
+	if t.Action == "" {
+		return fmt.Errorf("%w: unknown action %q", ErrInvalidTopic, fields["action"])
+	}
+	t.DeviceParam = fields["param"]
+
+	schema, hasSchema := fields["schema"]
+	tp, hasType := fields["device_type"]
+	id, hasID := fields["device_id"]
+	if hasSchema && hasType && hasID {
+		t.MessageType, t.DeviceType, t.DeviceID = schema, tp, id
+		return nil
+	}
+	a, ok := parseAlias(fields["alias"])
+	if !ok {
+		return fmt.Errorf("%w: unknown alias %q", ErrInvalidTopic, fields["alias"])
+	}
+	t.MessageType, t.DeviceType, t.DeviceID = a.Schema, a.DeviceType, a.DeviceID
 	return nil
 }
 
+// builds a regexp with a named group for each field of the template
+func topicPattern() *regexp.Regexp {
+	topicRegexpOnce.Do(func() {
+		tpl := cmd.ConfigData.TopicTemplate
+		var sb strings.Builder
+		sb.WriteString("^")
+		last := 0
+		for _, loc := range cmd.TopicPlaceholder.FindAllStringSubmatchIndex(tpl, -1) {
+			sb.WriteString(regexp.QuoteMeta(tpl[last:loc[0]]))
+			name := tpl[loc[2]:loc[3]]
+			if name == "base" {
+				sb.WriteString("(?P<base>" + regexp.QuoteMeta(cmd.ConfigData.MqttBaseTopic) + ")")
+			} else if name == "action" && cmd.ConfigData.TopicState == "" && strings.HasSuffix(sb.String(), "/") {
+				// the level of the state action is removed when its name is empty
+				prefix := strings.TrimSuffix(sb.String(), "/")
+				sb.Reset()
+				sb.WriteString(prefix + "(?:/(?P<action>[^/]+))?")
+			} else {
+				sb.WriteString("(?P<" + name + ">[^/]+)")
+			}
+			last = loc[1]
+		}
+		sb.WriteString(regexp.QuoteMeta(tpl[last:]) + "$")
+		topicRegexp = regexp.MustCompile(sb.String())
+	})
+	return topicRegexp
+}
+
+// name of the action in the topics
+func actionName(action string) string {
+	switch action {
+	case "state":
+		return cmd.ConfigData.TopicState
+	case "set":
+		return cmd.ConfigData.TopicSet
+	case "get":
+		return cmd.ConfigData.TopicGet
+	}
+	return action
+}
+
+// configured alias of the device, or schema_devicetype_deviceid
+func (t *Topic) alias() string {
+	for _, a := range cmd.ConfigData.Aliases {
+		if a.Schema == t.MessageType && a.DeviceType == t.DeviceType && a.DeviceID == t.DeviceID {
+			return a.Name
+		}
+	}
+	return t.MessageType + "_" + t.DeviceType + "_" + t.DeviceID
+}
+
+func parseAlias(name string) (cmd.Alias, bool) {
+	for _, a := range cmd.ConfigData.Aliases {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	s := strings.SplitN(name, "_", 3)
+	if len(s) != 3 || s[0] == "" || s[1] == "" || s[2] == "" {
+		return cmd.Alias{}, false
+	}
+	return cmd.Alias{Name: name, Schema: s[0], DeviceType: s[1], DeviceID: s[2]}, true
+}
+
+// whether the topic is a command or a get request, the state topics published by the bridge are received back and ignored
+func isCommandTopic(topic string) bool {
+	// the bridge topics (ex: the responses) are never commands
+	if strings.HasPrefix(topic, bridgeTopicPrefix()) {
+		return false
+	}
+	tpl := cmd.ConfigData.TopicTemplate
+	if strings.HasSuffix(tpl, "/{action}") {
+		return strings.HasSuffix(topic, "/"+cmd.ConfigData.TopicSet) || strings.HasSuffix(topic, "/"+cmd.ConfigData.TopicGet)
+	}
+	t := Topic{}
+	return t.Parse(topic) == nil && (t.Action == "set" || t.Action == "get")
+}
+
+// topics to subscribe to for the commands: the base topic, and the part of the template before its first field
+func CommandSubscriptions() []string {
+	res := []string{cmd.ConfigData.MqttBaseTopic + "/#"}
+	tpl := strings.ReplaceAll(cmd.ConfigData.TopicTemplate, "{base}", cmd.ConfigData.MqttBaseTopic)
+	levels := []string{}
+	for _, l := range strings.Split(tpl, "/") {
+		if cmd.TopicPlaceholder.MatchString(l) {
+			break
+		}
+		levels = append(levels, l)
+	}
+	prefix := strings.Join(append(levels, "#"), "/")
+	// overlapping subscriptions would receive the commands twice
+	p := strings.TrimSuffix(prefix, "#")
+	if strings.HasPrefix(cmd.ConfigData.MqttBaseTopic+"/", p) {
+		return []string{prefix}
+	}
+	if strings.HasPrefix(p, cmd.ConfigData.MqttBaseTopic+"/") {
+		return res
+	}
+	return append(res, prefix)
+}
+
+func bridgeTopicPrefix() string {
+	return cmd.ConfigData.MqttBaseTopic + "/bridge/"
+}
+
 func getStr(a string, b string) string {
 	if a != "" {
 		return a
@@ -0,0 +1,126 @@
+package xpl
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/droso-hass/xpl2mqtt/cmd"
+)
+
+// sets the topic configuration for a test, the template regexp is built again
+func setTopicConfig(t *testing.T, tpl string, state string, aliases []cmd.Alias) {
+	old := cmd.ConfigData
+	t.Cleanup(func() {
+		cmd.ConfigData = old
+		topicRegexpOnce = sync.Once{}
+	})
+	cmd.ConfigData.MqttBaseTopic = "xpl2mqtt"
+	cmd.ConfigData.TopicTemplate = tpl
+	cmd.ConfigData.TopicState = state
+	cmd.ConfigData.TopicSet = "set"
+	cmd.ConfigData.TopicGet = "get"
+	cmd.ConfigData.Aliases = aliases
+	topicRegexpOnce = sync.Once{}
+}
+
+func TestTopicRoundTrip(t *testing.T) {
+	aliases := []cmd.Alias{{Name: "kitchen", Schema: "x10.basic", DeviceType: "x10", DeviceID: "a1"}}
+	tests := []struct {
+		name     string
+		template string
+		state    string
+		topic    Topic
+		want     string
+	}{
+		{
+			name:     "default template",
+			template: "{base}/{schema}/{device_type}/{device_id}/{param}/{action}",
+			state:    "state",
+			topic:    Topic{MessageType: "sensor.basic", DeviceType: "th-1", DeviceID: "0x12345678", DeviceParam: "temp", Action: "state"},
+			want:     "xpl2mqtt/sensor.basic/th-1/0x12345678/temp/state",
+		},
+		{
+			name:     "default template with a command",
+			template: "{base}/{schema}/{device_type}/{device_id}/{param}/{action}",
+			state:    "state",
+			topic:    Topic{MessageType: "ac.basic", DeviceType: "ac", DeviceID: "0x123456-1", DeviceParam: "command", Action: "set"},
+			want:     "xpl2mqtt/ac.basic/ac/0x123456-1/command/set",
+		},
+		{
+			name:     "default template without state level",
+			template: "{base}/{schema}/{device_type}/{device_id}/{param}/{action}",
+			state:    "",
+			topic:    Topic{MessageType: "sensor.basic", DeviceType: "th-1", DeviceID: "0x12345678", DeviceParam: "temp", Action: "state"},
+			want:     "xpl2mqtt/sensor.basic/th-1/0x12345678/temp",
+		},
+		{
+			name:     "alias template",
+			template: "home/rf/{alias}/{param}/{action}",
+			state:    "state",
+			topic:    Topic{MessageType: "x10.basic", DeviceType: "x10", DeviceID: "a1", DeviceParam: "command", Action: "set"},
+			want:     "home/rf/kitchen/command/set",
+		},
+		{
+			name:     "alias template with the default alias",
+			template: "home/rf/{alias}/{param}/{action}",
+			state:    "state",
+			topic:    Topic{MessageType: "sensor.basic", DeviceType: "th-1", DeviceID: "0x12_34", DeviceParam: "temp", Action: "get"},
+			want:     "home/rf/sensor.basic_th-1_0x12_34/temp/get",
+		},
+		{
+			name:     "alias template without state level",
+			template: "home/rf/{alias}/{param}/{action}",
+			state:    "",
+			topic:    Topic{MessageType: "x10.basic", DeviceType: "x10", DeviceID: "a1", DeviceParam: "command", Action: "state"},
+			want:     "home/rf/kitchen/command",
+		},
+		{
+			name:     "base and alias template",
+			template: "{base}/{alias}/{action}/{param}",
+			state:    "status",
+			topic:    Topic{MessageType: "x10.basic", DeviceType: "x10", DeviceID: "a1", DeviceParam: "command", Action: "state"},
+			want:     "xpl2mqtt/kitchen/status/command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTopicConfig(t, tt.template, tt.state, aliases)
+			s := tt.topic.String()
+			if s != tt.want {
+				t.Errorf("got topic %q, want %q", s, tt.want)
+			}
+			res := Topic{}
+			err := res.Parse(s)
+			if err != nil {
+				t.Fatalf("unexpected error parsing %q: %s", s, err)
+			}
+			if res != tt.topic {
+				t.Errorf("got %+v, want %+v", res, tt.topic)
+			}
+		})
+	}
+}
+
+func TestTopicParseErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		topic    string
+	}{
+		{"other base topic", "{base}/{schema}/{device_type}/{device_id}/{param}/{action}", "other/sensor.basic/th-1/0x1/temp/state"},
+		{"missing level", "{base}/{schema}/{device_type}/{device_id}/{param}/{action}", "xpl2mqtt/sensor.basic/th-1/temp/state"},
+		{"unknown action", "{base}/{schema}/{device_type}/{device_id}/{param}/{action}", "xpl2mqtt/sensor.basic/th-1/0x1/temp/foo"},
+		{"unknown alias", "home/rf/{alias}/{param}/{action}", "home/rf/bedroom/command/set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTopicConfig(t, tt.template, "state", nil)
+			res := Topic{}
+			err := res.Parse(tt.topic)
+			if !errors.Is(err, ErrInvalidTopic) {
+				t.Errorf("got error %v, want ErrInvalidTopic", err)
+			}
+		})
+	}
+}